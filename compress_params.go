@@ -0,0 +1,250 @@
+package gozstd
+
+/*
+#cgo CFLAGS: -O3
+
+#define ZSTD_STATIC_LINKING_ONLY
+#include "zstd.h"
+#include "zstd_errors.h"
+
+#include <stdint.h>  // for uintptr_t
+
+// The following *_wrapper functions allow avoiding memory allocations
+// durting calls from Go.
+// See https://github.com/golang/go/issues/24450 .
+
+static size_t ZSTD_CCtxParams_setParameter_wrapper(uintptr_t params, ZSTD_cParameter param, int value) {
+    return ZSTD_CCtxParams_setParameter((ZSTD_CCtx_params*)params, param, value);
+}
+
+static size_t ZSTD_CCtx_setParametersUsingCCtxParams_wrapper(uintptr_t ctx, uintptr_t params) {
+    return ZSTD_CCtx_setParametersUsingCCtxParams((ZSTD_CCtx*)ctx, (const ZSTD_CCtx_params*)params);
+}
+
+static size_t ZSTD_CCtx_refCDict_params_wrapper(uintptr_t ctx, uintptr_t cdict) {
+    return ZSTD_CCtx_refCDict((ZSTD_CCtx*)ctx, (const ZSTD_CDict*)cdict);
+}
+
+static size_t ZSTD_compress2_wrapper(uintptr_t ctx, uintptr_t dst, size_t dstCapacity, uintptr_t src, size_t srcSize) {
+    return ZSTD_compress2((ZSTD_CCtx*)ctx, (void*)dst, dstCapacity, (const void*)src, srcSize);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// CompressParams is a set of compression parameters for CompressWithParams.
+//
+// CompressParams keeps a pool of compression contexts with the parameters
+// already applied, so it should be created once and then re-used.
+//
+// A single CompressParams may be re-used in concurrently running goroutines
+// calling CompressWithParams. It mustn't be modified while in use.
+type CompressParams struct {
+	p  *C.ZSTD_CCtx_params
+	cd *CDict
+
+	cctxPool *sync.Pool
+}
+
+// NewCompressParams returns new CompressParams with the given compressionLevel.
+//
+// Call Release when the returned params are no longer needed.
+func NewCompressParams(compressionLevel int) *CompressParams {
+	cp := &CompressParams{
+		p:        C.ZSTD_createCCtxParams(),
+		cctxPool: &sync.Pool{},
+	}
+	runtime.SetFinalizer(cp, freeCompressParams)
+
+	// Compression level cannot be out of bounds, since it is clamped by zstd.
+	if err := cp.SetCompressionLevel(compressionLevel); err != nil {
+		panic(fmt.Errorf("BUG: unexpected error: %w", err))
+	}
+	return cp
+}
+
+// SetCompressionLevel sets compression level in cp.
+//
+// The compression level is ignored if cp contains a dictionary.
+// The compression level of the dictionary is used instead.
+func (cp *CompressParams) SetCompressionLevel(compressionLevel int) error {
+	return cp.setParameter("CompressionLevel", C.ZSTD_c_compressionLevel, compressionLevel)
+}
+
+// SetChecksum enables or disables writing content checksum at the end of frames.
+func (cp *CompressParams) SetChecksum(enable bool) error {
+	value := 0
+	if enable {
+		value = 1
+	}
+	return cp.setParameter("Checksum", C.ZSTD_c_checksumFlag, value)
+}
+
+// SetWindowLog sets windowLog in cp.
+//
+// See WriterParams.WindowLog for details.
+func (cp *CompressParams) SetWindowLog(windowLog int) error {
+	return cp.setParameter("WindowLog", C.ZSTD_c_windowLog, windowLog)
+}
+
+// SetStrategy sets compression strategy in cp.
+func (cp *CompressParams) SetStrategy(strategy Strategy) error {
+	return cp.setParameter("Strategy", C.ZSTD_c_strategy, int(strategy))
+}
+
+// SetDict sets the dictionary used for compression.
+//
+// Pass nil cd for disabling the dictionary.
+func (cp *CompressParams) SetDict(cd *CDict) {
+	cp.cd = cd
+	cp.resetCCtxPool()
+}
+
+func (cp *CompressParams) setParameter(name string, param C.ZSTD_cParameter, value int) error {
+	if value != 0 {
+		if err := checkCParameter(name, param, value); err != nil {
+			return err
+		}
+	}
+	result := C.ZSTD_CCtxParams_setParameter_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(cp.p))),
+		param,
+		C.int(value))
+	if err := newError(result); err != nil {
+		return fmt.Errorf("cannot set %s=%d: %w", name, value, err)
+	}
+	cp.resetCCtxPool()
+	return nil
+}
+
+func (cp *CompressParams) resetCCtxPool() {
+	// Drop contexts with stale parameters.
+	cp.cctxPool = &sync.Pool{}
+}
+
+// Release releases resources occupied by cp.
+//
+// cp cannot be used after the release.
+func (cp *CompressParams) Release() {
+	if cp.p == nil {
+		return
+	}
+	result := C.ZSTD_freeCCtxParams(cp.p)
+	ensureNoError("ZSTD_freeCCtxParams", result)
+	cp.p = nil
+	cp.cd = nil
+	cp.cctxPool = nil
+}
+
+func freeCompressParams(v interface{}) {
+	v.(*CompressParams).Release()
+}
+
+func (cp *CompressParams) getCCtx(pool *sync.Pool) (*cctxWrapper, error) {
+	if v := pool.Get(); v != nil {
+		return v.(*cctxWrapper), nil
+	}
+
+	// Create new context with sticky parameters from cp.
+	cctx := newCCtx().(*cctxWrapper)
+	result := C.ZSTD_CCtx_setParametersUsingCCtxParams_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(cctx.cctx))),
+		C.uintptr_t(uintptr(unsafe.Pointer(cp.p))))
+	if err := newError(result); err != nil {
+		releaseCCtx(cctx)
+		return nil, fmt.Errorf("cannot apply compression params: %w", err)
+	}
+	if cp.cd != nil {
+		result := C.ZSTD_CCtx_refCDict_params_wrapper(
+			C.uintptr_t(uintptr(unsafe.Pointer(cctx.cctx))),
+			C.uintptr_t(uintptr(unsafe.Pointer(cp.cd.p))))
+		if err := newError(result); err != nil {
+			releaseCCtx(cctx)
+			return nil, fmt.Errorf("cannot set dictionary: %w", err)
+		}
+	}
+	return cctx, nil
+}
+
+// releaseCCtx frees cctx, which cannot be put to the pool.
+func releaseCCtx(cctx *cctxWrapper) {
+	runtime.SetFinalizer(cctx, nil)
+	freeCCtx(cctx)
+}
+
+// CompressWithParams appends compressed src to dst and returns the result.
+//
+// The given params cp are used for the compression.
+func CompressWithParams(dst, src []byte, cp *CompressParams) ([]byte, error) {
+	pool := cp.cctxPool
+	cctx, err := cp.getCCtx(pool)
+	if err != nil {
+		return dst, err
+	}
+
+	dst, err = compress2(cctx, dst, src)
+
+	// Keep cp.cd alive while it is referenced by cctx.
+	runtime.KeepAlive(cp)
+	pool.Put(cctx)
+	return dst, err
+}
+
+func compress2(cctx *cctxWrapper, dst, src []byte) ([]byte, error) {
+	if len(src) == 0 {
+		return dst, nil
+	}
+
+	dstLen := len(dst)
+	if cap(dst) > dstLen {
+		// Fast path - try compressing without dst resize.
+		result := compress2Internal(cctx, dst[dstLen:cap(dst)], src)
+		compressedSize := int(result)
+		if compressedSize >= 0 {
+			// All OK.
+			return dst[:dstLen+compressedSize], nil
+		}
+		if C.ZSTD_getErrorCode(result) != C.ZSTD_error_dstSize_tooSmall {
+			// Unexpected error.
+			return dst[:dstLen], fmt.Errorf("compression error: %w", newError(result))
+		}
+	}
+
+	// Slow path - resize dst to fit compressed data.
+	compressBound := int(C.ZSTD_compressBound(C.size_t(len(src)))) + 1
+	if n := dstLen + compressBound - cap(dst); n > 0 {
+		// This should be optimized since go 1.11 - see https://golang.org/doc/go1.11#performance-compiler.
+		dst = append(dst[:cap(dst)], make([]byte, n)...)
+	}
+
+	result := compress2Internal(cctx, dst[dstLen:dstLen+compressBound], src)
+	if err := newError(result); err != nil {
+		return dst[:dstLen], fmt.Errorf("compression error: %w", err)
+	}
+	compressedSize := int(result)
+	dst = dst[:dstLen+compressedSize]
+	if cap(dst)-len(dst) > 4096 {
+		// Re-allocate dst in order to remove superflouos capacity and reduce memory usage.
+		dst = append([]byte{}, dst...)
+	}
+	return dst, nil
+}
+
+func compress2Internal(cctx *cctxWrapper, dst, src []byte) C.size_t {
+	result := C.ZSTD_compress2_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(cctx.cctx))),
+		C.uintptr_t(uintptr(unsafe.Pointer(&dst[0]))),
+		C.size_t(cap(dst)),
+		C.uintptr_t(uintptr(unsafe.Pointer(&src[0]))),
+		C.size_t(len(src)))
+	// Prevent from GC'ing of dst and src during CGO call above.
+	runtime.KeepAlive(dst)
+	runtime.KeepAlive(src)
+	return result
+}
@@ -0,0 +1,172 @@
+package gozstd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCompressWithParams(t *testing.T) {
+	cp := NewCompressParams(5)
+	defer cp.Release()
+
+	for _, size := range []int{0, 1, 100, 1000, 64 * 1024, 1024 * 1024} {
+		src := []byte(newTestString(size, 10))
+		testCompressWithParams(t, cp, src)
+	}
+
+	if err := cp.SetChecksum(true); err != nil {
+		t.Fatalf("cannot enable checksum: %s", err)
+	}
+	if err := cp.SetWindowLog(20); err != nil {
+		t.Fatalf("cannot set window log: %s", err)
+	}
+	if err := cp.SetStrategy(StrategyBtOpt); err != nil {
+		t.Fatalf("cannot set strategy: %s", err)
+	}
+	src := []byte(newTestString(256*1024, 15))
+	compressedData := testCompressWithParams(t, cp, src)
+
+	// Verify the checksum is verified on decompression.
+	compressedData[len(compressedData)-1]++
+	_, err := Decompress(nil, compressedData)
+	if !errors.Is(err, ErrChecksumWrong) {
+		t.Fatalf("unexpected error for corrupted checksum; got %v; want %v", err, ErrChecksumWrong)
+	}
+}
+
+func TestCompressWithParamsDict(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf("this is a sample number %d", i)))
+	}
+	dict := BuildDict(samples, 8*1024)
+	cd, err := NewCDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	defer cd.Release()
+	dd, err := NewDDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create DDict: %s", err)
+	}
+	defer dd.Release()
+
+	cp := NewCompressParams(3)
+	defer cp.Release()
+	cp.SetDict(cd)
+
+	src := []byte("this is a sample number 12345")
+	compressedData, err := CompressWithParams(nil, src, cp)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	plainData, err := DecompressDict(nil, compressedData, dd)
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected decompressed data; got %q; want %q", plainData, src)
+	}
+
+	// Disable the dictionary.
+	cp.SetDict(nil)
+	compressedData, err = CompressWithParams(nil, src, cp)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	plainData, err = Decompress(nil, compressedData)
+	if err != nil {
+		t.Fatalf("cannot decompress data without dict: %s", err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected decompressed data; got %q; want %q", plainData, src)
+	}
+}
+
+func TestCompressParamsOutOfBounds(t *testing.T) {
+	cp := NewCompressParams(3)
+	defer cp.Release()
+
+	if err := cp.SetWindowLog(100); !errors.Is(err, ErrParameterOutOfBound) {
+		t.Fatalf("unexpected error for too big window log; got %v; want %v", err, ErrParameterOutOfBound)
+	}
+	if err := cp.SetStrategy(Strategy(100)); !errors.Is(err, ErrParameterOutOfBound) {
+		t.Fatalf("unexpected error for invalid strategy; got %v; want %v", err, ErrParameterOutOfBound)
+	}
+
+	// Params must remain usable after the errors above.
+	testCompressWithParams(t, cp, []byte(newTestString(1000, 3)))
+}
+
+func TestCompressWithParamsConcurrent(t *testing.T) {
+	cp := NewCompressParams(3)
+	defer cp.Release()
+	if err := cp.SetChecksum(true); err != nil {
+		t.Fatalf("cannot enable checksum: %s", err)
+	}
+
+	concurrency := 5
+	ch := make(chan error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			ch <- testCompressWithParamsSerial(cp)
+		}()
+	}
+	for i := 0; i < concurrency; i++ {
+		if err := <-ch; err != nil {
+			t.Fatalf("error in concurrent test: %s", err)
+		}
+	}
+}
+
+func testCompressWithParamsSerial(cp *CompressParams) error {
+	for i := 0; i < 100; i++ {
+		src := []byte(newTestString(i*100, 10))
+		compressedData, err := CompressWithParams(nil, src, cp)
+		if err != nil {
+			return fmt.Errorf("cannot compress data: %w", err)
+		}
+		plainData, err := Decompress(nil, compressedData)
+		if err != nil {
+			return fmt.Errorf("cannot decompress data: %w", err)
+		}
+		if !bytes.Equal(plainData, src) {
+			return fmt.Errorf("unexpected decompressed data for len(src)=%d", len(src))
+		}
+	}
+	return nil
+}
+
+func testCompressWithParams(t *testing.T, cp *CompressParams, src []byte) []byte {
+	t.Helper()
+
+	compressedData, err := CompressWithParams(nil, src, cp)
+	if err != nil {
+		t.Fatalf("cannot compress data with len(src)=%d: %s", len(src), err)
+	}
+	plainData, err := Decompress(nil, compressedData)
+	if err != nil {
+		t.Fatalf("cannot decompress data with len(src)=%d: %s", len(src), err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected decompressed data with len(src)=%d", len(src))
+	}
+
+	// Verify compression into a buffer with a prefix.
+	prefix := []byte("prefix")
+	dst := make([]byte, len(prefix), len(prefix)+len(src)+64)
+	copy(dst, prefix)
+	dst, err = CompressWithParams(dst, src, cp)
+	if err != nil {
+		t.Fatalf("cannot compress data into non-empty dst: %s", err)
+	}
+	if !bytes.HasPrefix(dst, prefix) {
+		t.Fatalf("missing prefix in the compressed data")
+	}
+	if !bytes.Equal(dst[len(prefix):], compressedData) {
+		t.Fatalf("unexpected compressed data in non-empty dst")
+	}
+	return compressedData
+}
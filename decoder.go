@@ -1,155 +1,254 @@
 package gozstd
 
-/*
-#cgo CFLAGS: -O3
-
-#define ZSTD_STATIC_LINKING_ONLY
-#include "zstd.h"
-#include "zstd_errors.h"
-
-#include <stdint.h>  // for uintptr_t
+import (
+	"fmt"
+	"sync"
+)
 
-#define ZSTD_MIN_ERR_CODE ((size_t) - ZSTD_error_maxCode)
-#define ZSTD_NO_ERR_CODE ((size_t) - 0)
+// Decoder decompresses data with the parameters set via DecoderOption.
+//
+// Every Decoder has its own pools of decompression contexts, which are used
+// for all the decompression paths, so Decoders may be used for isolating
+// the decompression with distinct parameters from each other.
+// Call Release for freeing the memory occupied by the pools.
+//
+// Decoder may be used from concurrently running goroutines.
+type Decoder struct {
+	opts  DecompressOptions
+	dicts map[uint32]*DDict
 
-// The following *_wrapper functions allow avoiding memory allocations
-// durting calls from Go.
-// See https://github.com/golang/go/issues/24450 .
+	dctxPool               decoderPool
+	streamDecompressorPool decoderPool
+}
 
-static size_t ZSTD_decompressDCtx_wrapper(uintptr_t ctx, uintptr_t dst, size_t dstCapacity, uintptr_t src, size_t srcSize) {
-    return ZSTD_decompressDCtx((ZSTD_DCtx*)ctx, (void*)dst, dstCapacity, (const void*)src, srcSize);
+// decoderPool is a pool of objects used by Decoder.
+//
+// Unlike sync.Pool, it never drops the objects put into it, so Decoder.Release
+// may free all of them. The number of objects in the pool is limited
+// by the maximum number of concurrent Decoder.Decompress calls.
+type decoderPool struct {
+	mu    sync.Mutex
+	items []interface{}
 }
 
-static unsigned long long ZSTD_getFrameContentSize_wrapper(uintptr_t src, size_t srcSize) {
-    return ZSTD_getFrameContentSize((const void*)src, srcSize);
+func (p *decoderPool) Get() interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := len(p.items)
+	if n == 0 {
+		return nil
+	}
+	v := p.items[n-1]
+	p.items[n-1] = nil
+	p.items = p.items[:n-1]
+	return v
 }
-*/
-import "C"
 
-import (
-	"fmt"
-	"runtime"
-	"sync"
-	"unsafe"
-)
+func (p *decoderPool) Put(v interface{}) {
+	p.mu.Lock()
+	p.items = append(p.items, v)
+	p.mu.Unlock()
+}
 
-// Decompress appends decompressed src to dst and returns the result.
+// drain removes all the objects from p and returns them.
+func (p *decoderPool) drain() []interface{} {
+	p.mu.Lock()
+	items := p.items
+	p.items = nil
+	p.mu.Unlock()
+	return items
+}
 
-type Decoder struct {
-	dctxPool               sync.Pool
-	streamDecompressorPool sync.Pool
+// DecoderOption is an option for NewDecoder.
+type DecoderOption func(d *Decoder) error
+
+// WithDecoderDict sets the dictionary for frames without dictionary id
+// in their headers.
+//
+// The dictionary is also selected for frames with the matching dictionary id.
+func WithDecoderDict(dd *DDict) DecoderOption {
+	return func(d *Decoder) error {
+		d.opts.Dict = dd
+		if dd != nil && dd.ID() != 0 {
+			return d.addDict(dd)
+		}
+		return nil
+	}
 }
 
-func newStreamDecompressor() interface{} {
-	sd := &streamDecompressor{
-		zr: NewReader(nil),
+// WithDecoderDicts registers dictionaries for the Decoder.
+//
+// The dictionary for each Decompress call is selected by the dictionary id
+// from the frame header, so data compressed with distinct dictionaries
+// may be decompressed with a single Decoder. All the frames in src passed
+// to Decompress must be compressed with the same dictionary.
+//
+// UnknownDictIDError is returned by Decompress if the frame requires
+// a dictionary, which isn't registered.
+func WithDecoderDicts(dds ...*DDict) DecoderOption {
+	return func(d *Decoder) error {
+		for _, dd := range dds {
+			if dd.ID() == 0 {
+				return fmt.Errorf("cannot register dictionary without id; use WithDecoderDict instead")
+			}
+			if err := d.addDict(dd); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
-	return sd
 }
 
-func newDecoder() *Decoder {
-	d := &Decoder{
-		dctxPool: sync.Pool{
-			New: newDCtx,
-		},
-		streamDecompressorPool: sync.Pool{
-			New: newStreamDecompressor,
-		},
+func (d *Decoder) addDict(dd *DDict) error {
+	id := dd.ID()
+	if prev := d.dicts[id]; prev != nil && prev != dd {
+		return fmt.Errorf("duplicate dictionary id %d", id)
+	}
+	if d.dicts == nil {
+		d.dicts = make(map[uint32]*DDict)
 	}
-	return d
+	d.dicts[id] = dd
+	return nil
 }
 
-func (d *Decoder) Decompress(dst, src []byte) ([]byte, error) {
-	if len(src) == 0 {
-		return dst, nil
+// WithDecoderMaxWindowLog sets the maximum windowLog accepted in frame headers.
+//
+// See DecompressOptions.MaxWindowLog for details.
+func WithDecoderMaxWindowLog(maxWindowLog int) DecoderOption {
+	return func(d *Decoder) error {
+		d.opts.MaxWindowLog = maxWindowLog
+		return nil
 	}
+}
 
-	dctx := d.dctxPool.Get().(*dctxWrapper)
-	defer d.dctxPool.Put(dctx)
+// WithDecoderMaxDecompressedSize sets the maximum size of decompressed data
+// returned from a single Decompress call.
+//
+// See DecompressOptions.MaxDecompressedSize for details.
+func WithDecoderMaxDecompressedSize(maxDecompressedSize int64) DecoderOption {
+	return func(d *Decoder) error {
+		d.opts.MaxDecompressedSize = maxDecompressedSize
+		return nil
+	}
+}
 
-	dstLen := len(dst)
-	if cap(dst) > dstLen+1024 {
-		// Fast path - try decompressing without dst resize.
-		result := decompressInternalD(dctx, dst[dstLen:cap(dst)], src)
-		decompressedSize := int(result)
-		if decompressedSize >= 0 {
-			// All OK.
-			return dst[:dstLen+decompressedSize], nil
-		}
+// WithDecoderSkipChecksum disables verification of content checksums.
+//
+// See DecompressOptions.SkipChecksum for details.
+func WithDecoderSkipChecksum(skip bool) DecoderOption {
+	return func(d *Decoder) error {
+		d.opts.SkipChecksum = skip
+		return nil
+	}
+}
 
-		if C.ZSTD_getErrorCode(result) != C.ZSTD_error_dstSize_tooSmall {
-			// Error during decompression.
-			return dst[:dstLen], fmt.Errorf("decompression error: %s", errStr(result))
+// NewDecoder returns new Decoder with the given options.
+//
+// Call Release when the Decoder is no longer needed.
+func NewDecoder(opts ...DecoderOption) (*Decoder, error) {
+	d := &Decoder{}
+	for _, opt := range opts {
+		if err := opt(d); err != nil {
+			return nil, err
 		}
 	}
-
-	// Slow path - resize dst to fit decompressed data.
-	decompressBound := int(C.ZSTD_getFrameContentSize_wrapper(
-		C.uintptr_t(uintptr(unsafe.Pointer(&src[0]))), C.size_t(len(src))))
-	// Prevent from GC'ing of src during CGO call above.
-	runtime.KeepAlive(src)
-	switch uint64(decompressBound) {
-	case uint64(C.ZSTD_CONTENTSIZE_UNKNOWN):
-		return streamDecompress(dst, src, nil)
-	case uint64(C.ZSTD_CONTENTSIZE_ERROR):
-		return dst, fmt.Errorf("cannot decompress invalid src")
+	if err := checkDecompressOptions(&d.opts); err != nil {
+		return nil, err
 	}
-	decompressBound++
+	return d, nil
+}
 
-	if dst == nil {
-		dst = make([]byte, decompressBound)
-	} else if n := dstLen + decompressBound - cap(dst); n > 0 {
-		// This should be optimized since go 1.11 - see https://golang.org/doc/go1.11#performance-compiler.
-		dst = append(dst[:cap(dst)], make([]byte, n)...)
+// Decompress appends decompressed src to dst and returns the result.
+func (d *Decoder) Decompress(dst, src []byte) ([]byte, error) {
+	opts := d.opts
+	if len(d.dicts) > 0 {
+		dd, err := d.selectDict(src)
+		if err != nil {
+			return dst, err
+		}
+		opts.Dict = dd
 	}
 
-	result := decompressInternalD(dctx, dst[dstLen:dstLen+decompressBound], src)
-	decompressedSize := int(result)
-	if decompressedSize >= 0 {
-		dst = dst[:dstLen+decompressedSize]
-		return dst, nil
+	v := d.dctxPool.Get()
+	if v == nil {
+		v = newDCtx()
 	}
+	dctx := v.(*dctxWrapper)
 
-	// Error during decompression.
-	return dst[:dstLen], fmt.Errorf("decompression error: %s", errStr(result))
-
-}
+	var err error
+	if opts.Dict == nil {
+		dst, err = decompress(dctx, nil, &d.streamDecompressorPool, dst, src, opts)
+	} else {
+		dst, err = decompress(nil, dctx, &d.streamDecompressorPool, dst, src, opts)
+	}
 
-func decompressInternalD(dctx *dctxWrapper, dst, src []byte) C.size_t {
-	n := C.ZSTD_decompressDCtx_wrapper(
-		C.uintptr_t(uintptr(unsafe.Pointer(dctx.dctx))),
-		C.uintptr_t(uintptr(unsafe.Pointer(&dst[0]))),
-		C.size_t(cap(dst)),
-		C.uintptr_t(uintptr(unsafe.Pointer(&src[0]))),
-		C.size_t(len(src)))
-	// Prevent from GC'ing of dst and src during CGO calls above.
-	runtime.KeepAlive(dst)
-	runtime.KeepAlive(src)
-	runtime.KeepAlive(dctx)
-	return n
+	d.dctxPool.Put(dctx)
+	return dst, err
 }
 
-func (d *Decoder) streamDecompress(dst, src []byte) ([]byte, error) {
-	sd := d.getStreamDecompressor()
-	sd.dst = dst
-	sd.src = src
-	_, err := sd.zr.WriteTo(sd)
-	dst = sd.dst
-	d.putStreamDecompressor(sd)
-	return dst, err
+// Release releases the memory occupied by the pools in d.
+//
+// It mustn't be called concurrently with Decompress calls.
+// d cannot be used after the release.
+func (d *Decoder) Release() {
+	for _, v := range d.dctxPool.drain() {
+		freeDCtx(v.(*dctxWrapper))
+	}
+	for _, v := range d.streamDecompressorPool.drain() {
+		v.(*streamDecompressor).zr.Release()
+	}
+	d.opts = DecompressOptions{}
+	d.dicts = nil
 }
 
-func (d *Decoder) getStreamDecompressor() *streamDecompressor {
-	v := d.streamDecompressorPool.Get()
-	sd := v.(*streamDecompressor)
-	sd.zr.Reset((*srcReader)(sd), nil)
-	return sd
+// selectDict returns the dictionary for the first zstd frame in src.
+func (d *Decoder) selectDict(src []byte) (*DDict, error) {
+	offset := 0
+	for offset < len(src) {
+		fh, err := ParseFrameHeader(src[offset:])
+		if err != nil {
+			// Let the decompressor report the error.
+			return d.opts.Dict, nil
+		}
+		if fh.Type == FrameTypeSkippable {
+			if fh.ContentSize > uint64(len(src)-offset-fh.HeaderSize) {
+				// Let the decompressor report the truncated frame.
+				break
+			}
+			offset += fh.HeaderSize + int(fh.ContentSize)
+			continue
+		}
+		if fh.DictID == 0 {
+			return d.opts.Dict, nil
+		}
+		dd := d.dicts[fh.DictID]
+		if dd == nil {
+			return nil, &UnknownDictIDError{
+				DictID: fh.DictID,
+			}
+		}
+		return dd, nil
+	}
+	return d.opts.Dict, nil
 }
 
-func (d *Decoder) putStreamDecompressor(sd *streamDecompressor) {
-	sd.dst = nil
-	sd.src = nil
-	sd.srcOffset = 0
-	sd.zr.Reset(nil, nil)
-	d.streamDecompressorPool.Put(sd)
+// DecompressStored appends src written by Encoder.CompressOrStore to dst
+// and returns the result.
+func (d *Decoder) DecompressStored(dst, src []byte) ([]byte, error) {
+	if len(src) == 0 {
+		return dst, fmt.Errorf("missing stored data marker: %w", ErrSrcSizeWrong)
+	}
+	marker := src[0]
+	src = src[1:]
+	switch marker {
+	case storedMarkerZstd:
+		return d.Decompress(dst, src)
+	case storedMarkerRaw:
+		if maxSize := d.opts.MaxDecompressedSize; maxSize > 0 && int64(len(src)) > maxSize {
+			return dst, fmt.Errorf("stored data size %d exceeds the limit %d: %w", len(src), maxSize, ErrDecompressedSizeTooLarge)
+		}
+		return append(dst, src...), nil
+	default:
+		return dst, fmt.Errorf("unknown stored data marker 0x%02X: %w", marker, ErrUnknownFrame)
+	}
 }
@@ -0,0 +1,375 @@
+package gozstd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestDecoder(t *testing.T) {
+	d, err := NewDecoder()
+	if err != nil {
+		t.Fatalf("cannot create Decoder: %s", err)
+	}
+	for _, size := range []int{0, 1, 100, 10000, 300 * 1024} {
+		src := []byte(newTestString(size, 10))
+		compressedData := Compress(nil, src)
+		plainData, err := d.Decompress(nil, compressedData)
+		if err != nil {
+			t.Fatalf("cannot decompress data for size=%d: %s", size, err)
+		}
+		if !bytes.Equal(plainData, src) {
+			t.Fatalf("unexpected data decompressed for size=%d", size)
+		}
+	}
+}
+
+func TestDecoderLimits(t *testing.T) {
+	src := []byte(newTestString(100*1024, 10))
+	compressedData := Compress(nil, src)
+
+	d, err := NewDecoder(WithDecoderMaxDecompressedSize(int64(len(src)) - 1))
+	if err != nil {
+		t.Fatalf("cannot create Decoder: %s", err)
+	}
+	if _, err := d.Decompress(nil, compressedData); !errors.Is(err, ErrDecompressedSizeTooLarge) {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrDecompressedSizeTooLarge)
+	}
+
+	var bb bytes.Buffer
+	zw := NewWriterParams(&bb, &WriterParams{
+		WindowLog: 20,
+	})
+	if err := testWriterExt(zw, string(src)); err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	zw.Release()
+	d, err = NewDecoder(WithDecoderMaxWindowLog(19))
+	if err != nil {
+		t.Fatalf("cannot create Decoder: %s", err)
+	}
+	if _, err := d.Decompress(nil, bb.Bytes()); !errors.Is(err, ErrWindowTooLarge) {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrWindowTooLarge)
+	}
+
+	if _, err := NewDecoder(WithDecoderMaxWindowLog(100)); !errors.Is(err, ErrParameterOutOfBound) {
+		t.Fatalf("unexpected error for invalid max window log; got %v; want %v", err, ErrParameterOutOfBound)
+	}
+	if _, err := NewDecoder(WithDecoderMaxDecompressedSize(-1)); err == nil {
+		t.Fatalf("expecting non-nil error for negative max decompressed size")
+	}
+}
+
+func TestDecoderSkipChecksum(t *testing.T) {
+	src := []byte(newTestString(100*1024, 10))
+	e, err := NewEncoder(WithEncoderChecksum(true))
+	if err != nil {
+		t.Fatalf("cannot create Encoder: %s", err)
+	}
+	defer e.Release()
+	compressedData, err := e.Compress(nil, src)
+	if err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	compressedData[len(compressedData)-1]++
+
+	d, err := NewDecoder()
+	if err != nil {
+		t.Fatalf("cannot create Decoder: %s", err)
+	}
+	defer d.Release()
+	if _, err := d.Decompress(nil, compressedData); !errors.Is(err, ErrChecksumWrong) {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrChecksumWrong)
+	}
+
+	dSkip, err := NewDecoder(WithDecoderSkipChecksum(true))
+	if err != nil {
+		t.Fatalf("cannot create Decoder: %s", err)
+	}
+	defer dSkip.Release()
+	plainData, err := dSkip.Decompress(nil, compressedData)
+	if err != nil {
+		t.Fatalf("cannot decompress data with skipped checksum: %s", err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected data decompressed")
+	}
+}
+
+func TestDecoderDict(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf("decoder sample %d", i)))
+	}
+	dict := BuildDict(samples, 8*1024)
+	cd, err := NewCDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	defer cd.Release()
+	dd, err := NewDDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create DDict: %s", err)
+	}
+	defer dd.Release()
+
+	e, err := NewEncoder(WithEncoderDict(cd))
+	if err != nil {
+		t.Fatalf("cannot create Encoder: %s", err)
+	}
+	defer e.Release()
+	d, err := NewDecoder(WithDecoderDict(dd))
+	if err != nil {
+		t.Fatalf("cannot create Decoder: %s", err)
+	}
+
+	src := []byte("decoder sample 12345")
+	compressedData, err := e.Compress(nil, src)
+	if err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	plainData, err := d.Decompress(nil, compressedData)
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected data decompressed; got %q; want %q", plainData, src)
+	}
+}
+
+func TestDecoderDecompressStoredError(t *testing.T) {
+	d, err := NewDecoder(WithDecoderMaxDecompressedSize(10))
+	if err != nil {
+		t.Fatalf("cannot create Decoder: %s", err)
+	}
+	f := func(src []byte, errExpected error) {
+		t.Helper()
+		_, err := d.DecompressStored(nil, src)
+		if !errors.Is(err, errExpected) {
+			t.Fatalf("unexpected error for src=%X; got %v; want %v", src, err, errExpected)
+		}
+	}
+	f(nil, ErrSrcSizeWrong)
+	f([]byte{0x42, 1, 2, 3}, ErrUnknownFrame)
+	f(append([]byte{storedMarkerRaw}, "too long raw data"...), ErrDecompressedSizeTooLarge)
+	f(append([]byte{storedMarkerZstd}, Compress(nil, []byte("too long compressed data"))...), ErrDecompressedSizeTooLarge)
+	f(append([]byte{storedMarkerZstd}, "invalid"...), ErrUnknownFrame)
+
+	plainData, err := d.DecompressStored(nil, append([]byte{storedMarkerRaw}, "foobar"...))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(plainData) != "foobar" {
+		t.Fatalf("unexpected data; got %q; want %q", plainData, "foobar")
+	}
+}
+
+func TestDecoderDicts(t *testing.T) {
+	var cds []*CDict
+	var dds []*DDict
+	for i := 0; i < 3; i++ {
+		var samples [][]byte
+		for j := 0; j < 1000; j++ {
+			samples = append(samples, []byte(fmt.Sprintf("dict %d sample %d", i, j)))
+		}
+		dict := BuildDict(samples, 8*1024)
+		cd, err := NewCDict(dict)
+		if err != nil {
+			t.Fatalf("cannot create CDict: %s", err)
+		}
+		defer cd.Release()
+		dd, err := NewDDict(dict)
+		if err != nil {
+			t.Fatalf("cannot create DDict: %s", err)
+		}
+		defer dd.Release()
+		if cd.ID() == 0 || cd.ID() != dd.ID() {
+			t.Fatalf("unexpected dictionary ids; CDict: %d, DDict: %d", cd.ID(), dd.ID())
+		}
+		cds = append(cds, cd)
+		dds = append(dds, dd)
+	}
+
+	d, err := NewDecoder(WithDecoderDicts(dds[:2]...))
+	if err != nil {
+		t.Fatalf("cannot create Decoder: %s", err)
+	}
+	for i, cd := range cds {
+		src := []byte(fmt.Sprintf("dict %d sample 12345", i))
+		compressedData := CompressDict(nil, src, cd)
+		plainData, err := d.Decompress(nil, compressedData)
+		if i == 2 {
+			var e *UnknownDictIDError
+			if !errors.As(err, &e) {
+				t.Fatalf("expecting UnknownDictIDError; got %v", err)
+			}
+			if e.DictID != cd.ID() {
+				t.Fatalf("unexpected dictionary id in the error; got %d; want %d", e.DictID, cd.ID())
+			}
+			if !errors.Is(err, ErrDictionaryWrong) {
+				t.Fatalf("expecting %v to match %v", err, ErrDictionaryWrong)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("cannot decompress data for dict #%d: %s", i, err)
+		}
+		if !bytes.Equal(plainData, src) {
+			t.Fatalf("unexpected data for dict #%d; got %q; want %q", i, plainData, src)
+		}
+
+		// Skippable frames before the zstd frame must be skipped.
+		withSkippable, err := AppendSkippableFrame(nil, 0, []byte("metadata"))
+		if err != nil {
+			t.Fatalf("cannot append skippable frame: %s", err)
+		}
+		withSkippable = append(withSkippable, compressedData...)
+		plainData, err = d.Decompress(nil, withSkippable)
+		if err != nil {
+			t.Fatalf("cannot decompress data with skippable frame for dict #%d: %s", i, err)
+		}
+		if !bytes.Equal(plainData, src) {
+			t.Fatalf("unexpected data with skippable frame for dict #%d; got %q; want %q", i, plainData, src)
+		}
+	}
+
+	// Frames without dictionary must be decompressed without it.
+	src := []byte("data without dictionary")
+	plainData, err := d.Decompress(nil, Compress(nil, src))
+	if err != nil {
+		t.Fatalf("cannot decompress data without dictionary: %s", err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected data; got %q; want %q", plainData, src)
+	}
+
+	if _, err := NewDecoder(WithDecoderDicts(dds[0]), WithDecoderDicts(dds[0])); err != nil {
+		t.Fatalf("unexpected error when registering the same dictionary twice: %s", err)
+	}
+}
+
+func TestDecoderStreamFallback(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf("stream sample %d", i)))
+	}
+	dict := BuildDict(samples, 8*1024)
+	cd, err := NewCDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	defer cd.Release()
+	dd, err := NewDDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create DDict: %s", err)
+	}
+	defer dd.Release()
+
+	// Compress data without content size in the frame header,
+	// so the Decoder falls back to stream decompression.
+	src := []byte(newTestString(100*1024, 10))
+	var bb bytes.Buffer
+	zw := NewWriterParams(&bb, &WriterParams{
+		Dict:          cd,
+		NoContentSize: true,
+	})
+	if err := testWriterExt(zw, string(src)); err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	zw.Release()
+	fh, err := ParseFrameHeader(bb.Bytes())
+	if err != nil {
+		t.Fatalf("cannot parse frame header: %s", err)
+	}
+	if fh.ContentSize != ContentSizeUnknown {
+		t.Fatalf("unexpected content size in the frame header; got %d; want %d", fh.ContentSize, ContentSizeUnknown)
+	}
+
+	d, err := NewDecoder(WithDecoderDicts(dd))
+	if err != nil {
+		t.Fatalf("cannot create Decoder: %s", err)
+	}
+	// Decompress the data multiple times, so the stream decompressors
+	// reused by the Decoder are verified too.
+	for i := 0; i < 3; i++ {
+		prefix := []byte("prefix")
+		plainData, err := d.Decompress(prefix, bb.Bytes())
+		if err != nil {
+			t.Fatalf("cannot decompress data: %s", err)
+		}
+		if !bytes.Equal(plainData, append(prefix, src...)) {
+			t.Fatalf("unexpected data decompressed")
+		}
+	}
+	d.Release()
+
+	d, err = NewDecoder(WithDecoderDicts(dd), WithDecoderMaxDecompressedSize(int64(len(src))-1))
+	if err != nil {
+		t.Fatalf("cannot create Decoder: %s", err)
+	}
+	defer d.Release()
+	if _, err := d.Decompress(nil, bb.Bytes()); !errors.Is(err, ErrDecompressedSizeTooLarge) {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrDecompressedSizeTooLarge)
+	}
+}
+
+func TestDecoderReleaseFreesContexts(t *testing.T) {
+	src := []byte(newTestString(100*1024, 10))
+	cd := Compress(nil, src)
+
+	// Frame without content size is decompressed via stream decompressor.
+	var bb bytes.Buffer
+	zw := NewWriterParams(&bb, &WriterParams{NoContentSize: true})
+	if err := testWriterExt(zw, string(src)); err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	zw.Release()
+	cdStream := bb.Bytes()
+
+	d, err := NewDecoder()
+	if err != nil {
+		t.Fatalf("cannot create Decoder: %s", err)
+	}
+	ch := make(chan error, 8)
+	for i := 0; i < cap(ch); i++ {
+		go func() {
+			for _, data := range [][]byte{cd, cdStream} {
+				plainData, err := d.Decompress(nil, data)
+				if err != nil {
+					ch <- err
+					return
+				}
+				if !bytes.Equal(plainData, src) {
+					ch <- fmt.Errorf("unexpected data decompressed")
+					return
+				}
+			}
+			ch <- nil
+		}()
+	}
+	for i := 0; i < cap(ch); i++ {
+		if err := <-ch; err != nil {
+			t.Fatalf("error in concurrent Decompress: %s", err)
+		}
+	}
+
+	dctxs := append([]interface{}{}, d.dctxPool.items...)
+	sds := append([]interface{}{}, d.streamDecompressorPool.items...)
+	if len(dctxs) == 0 || len(sds) == 0 {
+		t.Fatalf("expecting non-empty pools; got %d contexts and %d stream decompressors", len(dctxs), len(sds))
+	}
+	d.Release()
+
+	// All the contexts created by d must be freed.
+	for _, v := range dctxs {
+		if v.(*dctxWrapper).dctx != nil {
+			t.Fatalf("the context hasn't been freed by Release")
+		}
+	}
+	for _, v := range sds {
+		if v.(*streamDecompressor).zr.ds != nil {
+			t.Fatalf("the stream decompressor hasn't been freed by Release")
+		}
+	}
+}
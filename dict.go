@@ -148,6 +148,14 @@ func (cd *CDict) Release() {
 	cd.p = nil
 }
 
+// ID returns the dictionary id, which is written into frame headers
+// compressed with cd.
+//
+// 0 is returned for raw content dictionaries.
+func (cd *CDict) ID() uint32 {
+	return uint32(C.ZSTD_getDictID_fromCDict(cd.p))
+}
+
 func freeCDict(v interface{}) {
 	v.(*CDict).Release()
 }
@@ -191,6 +199,14 @@ func (dd *DDict) Release() {
 	dd.p = nil
 }
 
+// ID returns the dictionary id, which must match the dictionary id
+// in frame headers decompressed with dd.
+//
+// 0 is returned for raw content dictionaries.
+func (dd *DDict) ID() uint32 {
+	return uint32(C.ZSTD_getDictID_fromDDict(dd.p))
+}
+
 func freeDDict(v interface{}) {
 	v.(*DDict).Release()
 }
@@ -1,55 +1,81 @@
 package gozstd
 
-/*
-#cgo CFLAGS: -O3
-
-#define ZSTD_STATIC_LINKING_ONLY
-#include "zstd.h"
-#include "zstd_errors.h"
-
-#include <stdint.h>  // for uintptr_t
-
-#define ZSTD_MIN_ERR_CODE ((size_t) - ZSTD_error_maxCode)
-#define ZSTD_NO_ERR_CODE ((size_t) - 0)
+// Encoder compresses data with the parameters set via EncoderOption.
+//
+// Every Encoder has its own pool of compression contexts, so Encoders
+// may be used for isolating the compression with distinct parameters
+// from each other.
+//
+// Encoder may be used from concurrently running goroutines.
+type Encoder struct {
+	cp *CompressParams
+}
 
-// The following *_wrapper functions allow avoiding memory allocations
-// durting calls from Go.
-// See https://github.com/golang/go/issues/24450 .
+// EncoderOption is an option for NewEncoder.
+type EncoderOption func(e *Encoder) error
 
-static size_t ZSTD_compressCCtx_wrapper(uintptr_t ctx, uintptr_t dst, size_t dstCapacity, uintptr_t src, size_t srcSize, int compressionLevel) {
-    return ZSTD_compressCCtx((ZSTD_CCtx*)ctx, (void*)dst, dstCapacity, (const void*)src, srcSize, compressionLevel);
+// WithEncoderLevel sets the compression level for the Encoder.
+//
+// The default compression level is DefaultCompressionLevel.
+func WithEncoderLevel(compressionLevel int) EncoderOption {
+	return func(e *Encoder) error {
+		return e.cp.SetCompressionLevel(compressionLevel)
+	}
 }
 
-static size_t ZSTD_min_error_code() {
-    return ((size_t)-ZSTD_error_maxCode);
+// WithEncoderDict sets the dictionary for the Encoder.
+//
+// The compression level from the dictionary is used instead of the level
+// set via WithEncoderLevel.
+func WithEncoderDict(cd *CDict) EncoderOption {
+	return func(e *Encoder) error {
+		e.cp.SetDict(cd)
+		return nil
+	}
 }
-*/
-import "C"
 
-import (
-	"runtime"
-	"sync"
-	"unsafe"
-)
-
-const minErrCode = uint(C.ZSTD_MIN_ERR_CODE)
-const noErrCode = uint(C.ZSTD_NO_ERR_CODE)
+// WithEncoderChecksum enables or disables writing content checksum
+// at the end of frames.
+func WithEncoderChecksum(enable bool) EncoderOption {
+	return func(e *Encoder) error {
+		return e.cp.SetChecksum(enable)
+	}
+}
 
-type Encoder struct {
-	cctxPool         sync.Pool
-	compressionLevel int
+// WithEncoderWindowLog sets windowLog for the Encoder.
+//
+// See WriterParams.WindowLog for details.
+func WithEncoderWindowLog(windowLog int) EncoderOption {
+	return func(e *Encoder) error {
+		return e.cp.SetWindowLog(windowLog)
+	}
 }
 
-func newEncoder(compressionLevel int) *Encoder {
+// NewEncoder returns new Encoder with the given options.
+//
+// Call Release when the Encoder is no longer needed.
+func NewEncoder(opts ...EncoderOption) (*Encoder, error) {
 	e := &Encoder{
-		cctxPool: sync.Pool{
-			New: newCCtx,
-		},
-		compressionLevel: compressionLevel,
+		cp: NewCompressParams(DefaultCompressionLevel),
+	}
+	for _, opt := range opts {
+		if err := opt(e); err != nil {
+			e.Release()
+			return nil, err
+		}
 	}
-	return e
+	return e, nil
+}
+
+// Release releases resources occupied by e.
+//
+// e cannot be used after the release.
+func (e *Encoder) Release() {
+	e.cp.Release()
 }
 
+// CompressBound returns the maximum size of compressed data for src
+// of the given size.
 func CompressBound(srcSize int) int {
 	lowLimit := 131072 // 128 kB
 	var margin int
@@ -59,64 +85,34 @@ func CompressBound(srcSize int) int {
 	return srcSize + (srcSize >> 8) + margin
 }
 
-func (e *Encoder) Compress(dst, src []byte) []byte {
-	srcLen := len(src)
-	if srcLen == 0 {
-		return dst
-	}
+// Compress appends compressed src to dst and returns the result.
+func (e *Encoder) Compress(dst, src []byte) ([]byte, error) {
+	return CompressWithParams(dst, src, e.cp)
+}
 
-	cctx := e.cctxPool.Get().(*cctxWrapper)
-	defer e.cctxPool.Put(cctx)
+// Markers for the data written by Encoder.CompressOrStore.
+const (
+	storedMarkerRaw  = 0x00
+	storedMarkerZstd = 0x01
+)
 
+// CompressOrStore appends src to dst in compress-or-store mode
+// and returns the result.
+//
+// The appended data starts with a one-byte marker describing its contents:
+// compressed src is stored if it is shorter than src, otherwise src
+// is stored as is. The result must be decompressed with Decoder.DecompressStored.
+func (e *Encoder) CompressOrStore(dst, src []byte) ([]byte, error) {
 	dstLen := len(dst)
-	if cap(dst) > dstLen+1024 {
-		// Fast path - try compressing without dst resize.
-		result := compressInternalE(cctx, dst[dstLen:cap(dst)], src, e.compressionLevel)
-		compressedSize := uint(result)
-		if compressedSize <= minErrCode {
-			// All OK.
-			return dst[:uint(dstLen)+compressedSize]
-		}
-		if C.ZSTD_getErrorCode(result) != C.ZSTD_error_dstSize_tooSmall {
-			// Unexpected error.
-			return src
-		}
-	} else if dst == nil {
-		dst = make([]byte, CompressBound(srcLen)+1)
-		result := compressInternalE(cctx, dst, src, e.compressionLevel)
-		compressedSize := uint(result)
-		if compressedSize > minErrCode {
-			return src
-		}
-		return dst[:compressedSize]
+	dst = append(dst, storedMarkerZstd)
+	dst, err := CompressWithParams(dst, src, e.cp)
+	if err != nil {
+		return dst[:dstLen], err
 	}
-
-	// Slow path - resize dst to fit compressed data.
-	compressBound := CompressBound(srcLen) + 1
-	if n := dstLen + compressBound - cap(dst) + dstLen; n > 0 {
-		// This should be optimized since go 1.11 - see https://golang.org/doc/go1.11#performance-compiler.
-		dst = append(dst[:cap(dst)], make([]byte, n)...)
+	if compressedSize := len(dst) - dstLen - 1; compressedSize >= len(src) {
+		// Compression doesn't shrink src, so store it as is.
+		dst = append(dst[:dstLen], storedMarkerRaw)
+		dst = append(dst, src...)
 	}
-
-	result := compressInternalE(cctx, dst[dstLen:dstLen+compressBound], src, e.compressionLevel)
-	compressedSize := uint(result)
-	if compressedSize > minErrCode {
-		return src
-	}
-	return dst[:uint(dstLen)+compressedSize]
-}
-
-func compressInternalE(cctx *cctxWrapper, dst, src []byte, compressionLevel int) C.size_t {
-	result := C.ZSTD_compressCCtx_wrapper(
-		C.uintptr_t(uintptr(unsafe.Pointer(cctx.cctx))),
-		C.uintptr_t(uintptr(unsafe.Pointer(&dst[0]))),
-		C.size_t(cap(dst)),
-		C.uintptr_t(uintptr(unsafe.Pointer(&src[0]))),
-		C.size_t(len(src)),
-		C.int(compressionLevel))
-	// Prevent from GC'ing of dst and src during CGO call above.
-	runtime.KeepAlive(dst)
-	runtime.KeepAlive(src)
-	runtime.KeepAlive(cctx)
-	return result
+	return dst, nil
 }
@@ -0,0 +1,129 @@
+package gozstd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestEncoder(t *testing.T) {
+	e, err := NewEncoder(WithEncoderLevel(7), WithEncoderChecksum(true), WithEncoderWindowLog(20))
+	if err != nil {
+		t.Fatalf("cannot create Encoder: %s", err)
+	}
+	defer e.Release()
+
+	for _, size := range []int{0, 1, 100, 10000, 300 * 1024} {
+		src := []byte(newTestString(size, 10))
+		compressedData, err := e.Compress(nil, src)
+		if err != nil {
+			t.Fatalf("cannot compress data for size=%d: %s", size, err)
+		}
+		if size > 0 {
+			fh, err := ParseFrameHeader(compressedData)
+			if err != nil {
+				t.Fatalf("cannot parse frame header: %s", err)
+			}
+			if !fh.HasChecksum {
+				t.Fatalf("missing checksum in the frame for size=%d", size)
+			}
+		}
+		plainData, err := Decompress(nil, compressedData)
+		if err != nil {
+			t.Fatalf("cannot decompress data for size=%d: %s", size, err)
+		}
+		if !bytes.Equal(plainData, src) {
+			t.Fatalf("unexpected data decompressed for size=%d", size)
+		}
+	}
+}
+
+func TestEncoderDict(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf("encoder sample %d", i)))
+	}
+	dict := BuildDict(samples, 8*1024)
+	cd, err := NewCDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	defer cd.Release()
+	dd, err := NewDDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create DDict: %s", err)
+	}
+	defer dd.Release()
+
+	e, err := NewEncoder(WithEncoderDict(cd))
+	if err != nil {
+		t.Fatalf("cannot create Encoder: %s", err)
+	}
+	defer e.Release()
+
+	src := []byte("encoder sample 12345")
+	compressedData, err := e.Compress(nil, src)
+	if err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	plainData, err := DecompressDict(nil, compressedData, dd)
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected data decompressed; got %q; want %q", plainData, src)
+	}
+}
+
+func TestNewEncoderInvalidOptions(t *testing.T) {
+	if _, err := NewEncoder(WithEncoderWindowLog(100)); !errors.Is(err, ErrParameterOutOfBound) {
+		t.Fatalf("unexpected error for invalid window log; got %v; want %v", err, ErrParameterOutOfBound)
+	}
+}
+
+func TestEncoderCompressOrStore(t *testing.T) {
+	e, err := NewEncoder()
+	if err != nil {
+		t.Fatalf("cannot create Encoder: %s", err)
+	}
+	defer e.Release()
+	d, err := NewDecoder()
+	if err != nil {
+		t.Fatalf("cannot create Decoder: %s", err)
+	}
+
+	f := func(src []byte, markerExpected byte) {
+		t.Helper()
+		prefix := []byte("prefix")
+		result, err := e.CompressOrStore(append([]byte{}, prefix...), src)
+		if err != nil {
+			t.Fatalf("cannot compress data: %s", err)
+		}
+		if !bytes.HasPrefix(result, prefix) {
+			t.Fatalf("missing prefix in the result")
+		}
+		stored := result[len(prefix):]
+		if stored[0] != markerExpected {
+			t.Fatalf("unexpected marker; got 0x%02X; want 0x%02X", stored[0], markerExpected)
+		}
+		if markerExpected == storedMarkerZstd && len(stored)-1 >= len(src) {
+			t.Fatalf("compressed data must be shorter than src; got %d bytes; src has %d bytes", len(stored)-1, len(src))
+		}
+		plainData, err := d.DecompressStored(append([]byte{}, prefix...), stored)
+		if err != nil {
+			t.Fatalf("cannot decompress stored data: %s", err)
+		}
+		if !bytes.Equal(plainData[len(prefix):], src) {
+			t.Fatalf("unexpected data; got %q; want %q", plainData[len(prefix):], src)
+		}
+	}
+
+	// Incompressible data must be stored as is.
+	f(nil, storedMarkerRaw)
+	f([]byte("x"), storedMarkerRaw)
+	f([]byte(newTestString(1000, 255)), storedMarkerRaw)
+
+	// Compressible data must be compressed.
+	f([]byte(newTestString(100000, 3)), storedMarkerZstd)
+}
@@ -0,0 +1,143 @@
+package gozstd
+
+/*
+#cgo CFLAGS: -O3
+
+#define ZSTD_STATIC_LINKING_ONLY
+#include "zstd.h"
+#include "zstd_errors.h"
+
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorCode is zstd error code. See zstd_errors.h for the list of codes.
+type ErrorCode int
+
+// Error is an error returned by the underlying zstd library.
+//
+// Use errors.Is with one of the Err* values for checking the error kind
+// and errors.As for obtaining the error code.
+type Error struct {
+	// Code is zstd error code.
+	Code ErrorCode
+}
+
+// Error implements error interface.
+func (e *Error) Error() string {
+	return C.GoString(C.ZSTD_getErrorString(C.ZSTD_ErrorCode(e.Code)))
+}
+
+// Is returns true if target is *Error with the same Code as e.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+var (
+	// ErrUnknownFrame is returned when src doesn't start with a known frame magic.
+	ErrUnknownFrame = newKnownError(C.ZSTD_error_prefix_unknown)
+
+	// ErrVersionUnsupported is returned for frames written with unsupported zstd version.
+	ErrVersionUnsupported = newKnownError(C.ZSTD_error_version_unsupported)
+
+	// ErrFrameParameterUnsupported is returned for frames with unsupported header parameters.
+	ErrFrameParameterUnsupported = newKnownError(C.ZSTD_error_frameParameter_unsupported)
+
+	// ErrWindowTooLarge is returned when the frame requires bigger window than allowed.
+	ErrWindowTooLarge = newKnownError(C.ZSTD_error_frameParameter_windowTooLarge)
+
+	// ErrCorrupted is returned when the compressed data is corrupted.
+	ErrCorrupted = newKnownError(C.ZSTD_error_corruption_detected)
+
+	// ErrChecksumWrong is returned when the frame checksum doesn't match the decompressed data.
+	ErrChecksumWrong = newKnownError(C.ZSTD_error_checksum_wrong)
+
+	// ErrDictionaryCorrupted is returned when the dictionary is corrupted.
+	ErrDictionaryCorrupted = newKnownError(C.ZSTD_error_dictionary_corrupted)
+
+	// ErrDictionaryWrong is returned when the frame requires another dictionary.
+	ErrDictionaryWrong = newKnownError(C.ZSTD_error_dictionary_wrong)
+
+	// ErrParameterUnsupported is returned when an unsupported parameter is passed to zstd.
+	ErrParameterUnsupported = newKnownError(C.ZSTD_error_parameter_unsupported)
+
+	// ErrParameterOutOfBound is returned when a parameter value is out of bounds.
+	ErrParameterOutOfBound = newKnownError(C.ZSTD_error_parameter_outOfBound)
+
+	// ErrMemoryAllocation is returned when zstd cannot allocate memory.
+	ErrMemoryAllocation = newKnownError(C.ZSTD_error_memory_allocation)
+
+	// ErrDstSizeTooSmall is returned when the destination buffer is too small.
+	ErrDstSizeTooSmall = newKnownError(C.ZSTD_error_dstSize_tooSmall)
+
+	// ErrSrcSizeWrong is returned when src size doesn't match the expected size.
+	ErrSrcSizeWrong = newKnownError(C.ZSTD_error_srcSize_wrong)
+)
+
+// ErrDecompressedSizeTooLarge is returned when the decompressed data exceeds
+// the configured limit.
+var ErrDecompressedSizeTooLarge = errors.New("decompressed size exceeds the limit")
+
+// UnknownDictIDError is returned by Decoder when the frame requires
+// a dictionary, which isn't registered in the Decoder.
+//
+// errors.Is(err, ErrDictionaryWrong) returns true for it.
+type UnknownDictIDError struct {
+	// DictID is the dictionary id from the frame header.
+	DictID uint32
+}
+
+// Error implements error interface.
+func (e *UnknownDictIDError) Error() string {
+	return fmt.Sprintf("unknown dictionary id %d", e.DictID)
+}
+
+// Is returns true if target is ErrDictionaryWrong.
+func (e *UnknownDictIDError) Is(target error) bool {
+	return ErrDictionaryWrong.Is(target)
+}
+
+var knownErrors = make(map[ErrorCode]*Error)
+
+func newKnownError(code C.ZSTD_ErrorCode) *Error {
+	e := &Error{
+		Code: ErrorCode(code),
+	}
+	knownErrors[e.Code] = e
+	return e
+}
+
+// newError returns an error for the given result of zstd function call.
+//
+// nil is returned if the result doesn't contain an error.
+func newError(result C.size_t) error {
+	if int(result) >= 0 {
+		// Fast path - avoid calling C function.
+		return nil
+	}
+	code := ErrorCode(C.ZSTD_getErrorCode(result))
+	if code == 0 {
+		return nil
+	}
+	if e := knownErrors[code]; e != nil {
+		return e
+	}
+	return &Error{
+		Code: code,
+	}
+}
+
+// invalidSrcError returns an error explaining why the frame header in src
+// cannot be parsed.
+func invalidSrcError(src []byte) error {
+	if _, err := ParseFrameHeader(src); err != nil {
+		return err
+	}
+	// The frame header is valid, so the rest of the frame is missing.
+	return ErrSrcSizeWrong
+}
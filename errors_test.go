@@ -0,0 +1,117 @@
+package gozstd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestDecompressErrors(t *testing.T) {
+	// Invalid frame magic.
+	_, err := Decompress(nil, []byte("invalid compressed data"))
+	if !errors.Is(err, ErrUnknownFrame) {
+		t.Fatalf("unexpected error for invalid data; got %v; want %v", err, ErrUnknownFrame)
+	}
+	buf := make([]byte, 0, 1024)
+	_, err = Decompress(buf, []byte("invalid compressed data"))
+	if !errors.Is(err, ErrUnknownFrame) {
+		t.Fatalf("unexpected error for invalid data with non-empty buf; got %v; want %v", err, ErrUnknownFrame)
+	}
+
+	// Truncated frame header.
+	cd := Compress(nil, []byte(newTestString(1024, 10)))
+	_, err = Decompress(nil, cd[:5])
+	if !errors.Is(err, ErrSrcSizeWrong) {
+		t.Fatalf("unexpected error for truncated frame header; got %v; want %v", err, ErrSrcSizeWrong)
+	}
+
+	// Corrupted data.
+	cd = Compress(nil, []byte(newTestString(64*1024, 15)))
+	cd[len(cd)-1]++
+	_, err = Decompress(nil, cd)
+	var zerr *Error
+	if !errors.As(err, &zerr) {
+		t.Fatalf("expecting *Error for corrupted data; got %T: %v", err, err)
+	}
+	if zerr.Code == 0 {
+		t.Fatalf("expecting non-zero error code for corrupted data")
+	}
+}
+
+func TestDecompressDictWrongError(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf("sample %d for errors", i)))
+	}
+	dict := BuildDict(samples, 8*1024)
+	cd, err := NewCDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	defer cd.Release()
+
+	src := []byte(newTestString(1024, 10))
+	compressedData := CompressDict(nil, src, cd)
+
+	_, err = Decompress(nil, compressedData)
+	if !errors.Is(err, ErrDictionaryWrong) {
+		t.Fatalf("unexpected error when decompressing without dict; got %v; want %v", err, ErrDictionaryWrong)
+	}
+
+	zr := NewReader(bytes.NewReader(compressedData))
+	defer zr.Release()
+	_, err = ioutil.ReadAll(zr)
+	if !errors.Is(err, ErrDictionaryWrong) {
+		t.Fatalf("unexpected error when stream decompressing without dict; got %v; want %v", err, ErrDictionaryWrong)
+	}
+}
+
+func TestErrorIs(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", &Error{Code: ErrCorrupted.Code})
+	if !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expecting %v to match %v", err, ErrCorrupted)
+	}
+	if errors.Is(err, ErrChecksumWrong) {
+		t.Fatalf("unexpected match of %v with %v", err, ErrChecksumWrong)
+	}
+	if ErrChecksumWrong.Error() == "" {
+		t.Fatalf("expecting non-empty error message")
+	}
+}
+
+func TestUnderlyingErrorsWrapped(t *testing.T) {
+	errReader := errors.New("reader failure")
+	zr := NewReader(&errorReader{err: errReader})
+	defer zr.Release()
+	if _, err := ioutil.ReadAll(zr); !errors.Is(err, errReader) {
+		t.Fatalf("unexpected error from Reader; got %v; want %v", err, errReader)
+	}
+
+	errWriter := errors.New("writer failure")
+	zw := NewWriter(&errorWriter{err: errWriter})
+	defer zw.Release()
+	if _, err := zw.Write([]byte("foobar")); err != nil {
+		t.Fatalf("unexpected error in Write: %s", err)
+	}
+	if err := zw.Close(); !errors.Is(err, errWriter) {
+		t.Fatalf("unexpected error from Writer; got %v; want %v", err, errWriter)
+	}
+}
+
+type errorReader struct {
+	err error
+}
+
+func (er *errorReader) Read(p []byte) (int, error) {
+	return 0, er.err
+}
+
+type errorWriter struct {
+	err error
+}
+
+func (ew *errorWriter) Write(p []byte) (int, error) {
+	return 0, ew.err
+}
@@ -0,0 +1,398 @@
+package gozstd
+
+/*
+#cgo CFLAGS: -O3
+
+#define ZSTD_STATIC_LINKING_ONLY
+#include "zstd.h"
+#include "zstd_errors.h"
+
+#include <stdint.h>  // for uintptr_t
+
+// The following *_wrapper functions allow avoiding memory allocations
+// durting calls from Go.
+// See https://github.com/golang/go/issues/24450 .
+
+// zfh is passed as a pointer, so cgo pins it during the call.
+// It mustn't be passed as uintptr_t, since it may live on the Go stack,
+// which may be moved while entering the call.
+static size_t ZSTD_getFrameHeader_advanced_wrapper(ZSTD_frameHeader* zfh, uintptr_t src, size_t srcSize) {
+    return ZSTD_getFrameHeader_advanced(zfh, (const void*)src, srcSize, ZSTD_f_zstd1);
+}
+
+static size_t ZSTD_findFrameCompressedSize_wrapper(uintptr_t src, size_t srcSize) {
+    return ZSTD_findFrameCompressedSize((const void*)src, srcSize);
+}
+
+static unsigned ZSTD_isSkippableFrame_wrapper(uintptr_t src, size_t srcSize) {
+    return ZSTD_isSkippableFrame((const void*)src, srcSize);
+}
+
+static size_t ZSTD_writeSkippableFrame_wrapper(uintptr_t dst, size_t dstCapacity, uintptr_t src, size_t srcSize, unsigned magicVariant) {
+    return ZSTD_writeSkippableFrame((void*)dst, dstCapacity, (const void*)src, srcSize, magicVariant);
+}
+
+// magicVariant is passed as a pointer for the same reason as zfh above.
+static size_t ZSTD_readSkippableFrame_wrapper(uintptr_t dst, size_t dstCapacity, unsigned* magicVariant, uintptr_t src, size_t srcSize) {
+    return ZSTD_readSkippableFrame((void*)dst, dstCapacity, magicVariant, (const void*)src, srcSize);
+}
+
+static unsigned long long ZSTD_getFrameContentSize_frame_wrapper(uintptr_t src, size_t srcSize) {
+    return ZSTD_getFrameContentSize((const void*)src, srcSize);
+}
+*/
+import "C"
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"unsafe"
+)
+
+// FrameType is the type of a frame.
+type FrameType int
+
+// Frame types.
+const (
+	// FrameTypeZstd is a regular zstd frame containing compressed data.
+	FrameTypeZstd = FrameType(C.ZSTD_frame)
+
+	// FrameTypeSkippable is a skippable frame containing user data,
+	// which is ignored by the decompressor.
+	FrameTypeSkippable = FrameType(C.ZSTD_skippableFrame)
+)
+
+// ContentSizeUnknown is set in FrameHeader.ContentSize when the frame
+// doesn't contain the size of the decompressed data.
+const ContentSizeUnknown = ^uint64(0) // Obtained from ZSTD_CONTENTSIZE_UNKNOWN.
+
+// FrameHeader contains information from the header of a frame.
+//
+// Use ParseFrameHeader for obtaining it.
+type FrameHeader struct {
+	// Type is the frame type.
+	Type FrameType
+
+	// ContentSize is the decompressed size of the frame.
+	//
+	// It is set to ContentSizeUnknown if the frame header doesn't contain it.
+	// It is set to the size of user data for skippable frames.
+	ContentSize uint64
+
+	// WindowSize is the window size required for decompressing the frame.
+	//
+	// It is 0 for skippable frames.
+	WindowSize uint64
+
+	// BlockSizeMax is the maximum size of a block in the frame.
+	BlockSizeMax int
+
+	// DictID is the id of the dictionary required for decompressing the frame.
+	//
+	// It is 0 if the frame doesn't require a dictionary or if the compressor
+	// didn't write the dictionary id into the frame.
+	DictID uint32
+
+	// MagicVariant is the magic variant (0..15) of a skippable frame.
+	//
+	// It is 0 for zstd frames.
+	MagicVariant uint32
+
+	// HasChecksum is set to true if the frame ends with a content checksum.
+	HasChecksum bool
+
+	// HeaderSize is the size of the frame header in bytes.
+	HeaderSize int
+}
+
+// ParseFrameHeader parses the header of the frame at the start of src.
+//
+// src may contain only a part of the frame - it is enough to pass
+// the first 18 bytes of the frame. ErrSrcSizeWrong is returned if src
+// is too short for the header.
+func ParseFrameHeader(src []byte) (FrameHeader, error) {
+	if len(src) == 0 {
+		return FrameHeader{}, fmt.Errorf("empty frame header: %w", ErrSrcSizeWrong)
+	}
+
+	var zfh C.ZSTD_frameHeader
+	result := C.ZSTD_getFrameHeader_advanced_wrapper(
+		&zfh,
+		C.uintptr_t(uintptr(unsafe.Pointer(&src[0]))),
+		C.size_t(len(src)))
+	// Prevent from GC'ing of src during CGO call above.
+	runtime.KeepAlive(src)
+
+	if err := newError(result); err != nil {
+		return FrameHeader{}, err
+	}
+	if result > 0 {
+		return FrameHeader{}, fmt.Errorf("incomplete frame header; need at least %d bytes; got %d bytes: %w",
+			int(result), len(src), ErrSrcSizeWrong)
+	}
+	if zfh.frameType == C.ZSTD_skippableFrame {
+		// zstd doesn't fill the remaining fields for skippable frames.
+		magic := binary.LittleEndian.Uint32(src)
+		return FrameHeader{
+			Type:         FrameTypeSkippable,
+			ContentSize:  uint64(zfh.frameContentSize),
+			MagicVariant: magic - C.ZSTD_MAGIC_SKIPPABLE_START,
+			HeaderSize:   C.ZSTD_SKIPPABLEHEADERSIZE,
+		}, nil
+	}
+	return FrameHeader{
+		Type:         FrameType(zfh.frameType),
+		ContentSize:  uint64(zfh.frameContentSize),
+		WindowSize:   uint64(zfh.windowSize),
+		BlockSizeMax: int(zfh.blockSizeMax),
+		DictID:       uint32(zfh.dictID),
+		HasChecksum:  zfh.checksumFlag != 0,
+		HeaderSize:   int(zfh.headerSize),
+	}, nil
+}
+
+// FrameInfo contains information about a frame returned by FrameIterator.
+type FrameInfo struct {
+	// Offset is the offset of the frame in the source data.
+	Offset int
+
+	// CompressedSize is the size of the frame in the source data.
+	CompressedSize int
+
+	// DecompressedSize is the decompressed size of the frame.
+	//
+	// It is set to ContentSizeUnknown if the frame header doesn't contain it.
+	// It is 0 for skippable frames.
+	DecompressedSize uint64
+
+	// Type is the frame type.
+	Type FrameType
+}
+
+// FrameIterator iterates over frames in concatenated zstd data.
+//
+// The frames aren't decompressed, so data corruption inside frame blocks
+// isn't detected by the iterator.
+//
+// Usage:
+//
+//	it := NewFrameIterator(src)
+//	for it.Next() {
+//		fi := it.Frame()
+//		frame := src[fi.Offset : fi.Offset+fi.CompressedSize]
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type FrameIterator struct {
+	src    []byte
+	offset int
+	fi     FrameInfo
+	err    error
+}
+
+// NewFrameIterator returns an iterator over frames in src.
+func NewFrameIterator(src []byte) *FrameIterator {
+	return &FrameIterator{
+		src: src,
+	}
+}
+
+// Next advances the iterator to the next frame.
+//
+// It returns false when there are no more frames or on error.
+// Check Err after Next returns false.
+func (it *FrameIterator) Next() bool {
+	if it.err != nil || it.offset >= len(it.src) {
+		return false
+	}
+	frame := it.src[it.offset:]
+	frameSize, err := findFrameCompressedSize(frame)
+	if err != nil {
+		it.err = fmt.Errorf("cannot find frame size at offset %d: %w", it.offset, err)
+		return false
+	}
+	fi := FrameInfo{
+		Offset:         it.offset,
+		CompressedSize: frameSize,
+		Type:           FrameTypeZstd,
+	}
+	if IsSkippableFrame(frame) {
+		fi.Type = FrameTypeSkippable
+	} else {
+		fi.DecompressedSize = getFrameContentSize(frame)
+	}
+	it.fi = fi
+	it.offset += frameSize
+	return true
+}
+
+// Frame returns information about the current frame.
+func (it *FrameIterator) Frame() FrameInfo {
+	return it.fi
+}
+
+// Err returns the error occurred during the iteration.
+//
+// The data up to Offset+CompressedSize of the last successfully returned
+// frame consists of complete frames, so it may be used for repairing
+// truncated data.
+func (it *FrameIterator) Err() error {
+	return it.err
+}
+
+// SplitFrames splits concatenated frames in src into separate frames.
+//
+// The returned frames point to src.
+func SplitFrames(src []byte) ([][]byte, error) {
+	var frames [][]byte
+	it := NewFrameIterator(src)
+	for it.Next() {
+		fi := it.Frame()
+		frames = append(frames, src[fi.Offset:fi.Offset+fi.CompressedSize:fi.Offset+fi.CompressedSize])
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return frames, nil
+}
+
+// CountFrames returns the number of concatenated frames in src.
+func CountFrames(src []byte) (int, error) {
+	n := 0
+	it := NewFrameIterator(src)
+	for it.Next() {
+		n++
+	}
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// MaxSkippableMagicVariant is the maximum magic variant for skippable frames.
+const MaxSkippableMagicVariant = 15
+
+// AppendSkippableFrame appends a skippable frame with the given magicVariant
+// and payload to dst and returns the result.
+//
+// Skippable frames are ignored by the decompressor, so they may be used
+// for storing user data among zstd frames. Use ReadSkippableFrame for reading
+// the payload back or ReaderParams.SkippableFrameHandler for obtaining it
+// while streaming.
+//
+// magicVariant must be in the range [0..MaxSkippableMagicVariant].
+// The payload size is limited by 4GB-1.
+func AppendSkippableFrame(dst []byte, magicVariant uint32, payload []byte) ([]byte, error) {
+	if magicVariant > MaxSkippableMagicVariant {
+		return dst, fmt.Errorf("magicVariant must be in the range [0..%d]; got %d: %w",
+			MaxSkippableMagicVariant, magicVariant, ErrParameterOutOfBound)
+	}
+
+	dstLen := len(dst)
+	frameSize := C.ZSTD_SKIPPABLEHEADERSIZE + len(payload)
+	if n := dstLen + frameSize - cap(dst); n > 0 {
+		dst = append(dst[:cap(dst)], make([]byte, n)...)
+	}
+	dst = dst[:dstLen+frameSize]
+
+	var payloadPtr *byte
+	if len(payload) > 0 {
+		payloadPtr = &payload[0]
+	}
+	result := C.ZSTD_writeSkippableFrame_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(&dst[dstLen]))),
+		C.size_t(frameSize),
+		C.uintptr_t(uintptr(unsafe.Pointer(payloadPtr))),
+		C.size_t(len(payload)),
+		C.unsigned(magicVariant))
+	// Prevent from GC'ing of dst and payload during CGO call above.
+	runtime.KeepAlive(dst)
+	runtime.KeepAlive(payload)
+	if err := newError(result); err != nil {
+		return dst[:dstLen], fmt.Errorf("cannot write skippable frame: %w", err)
+	}
+	return dst, nil
+}
+
+// ReadSkippableFrame appends the payload of the skippable frame at the start
+// of src to dst and returns the result together with the frame magic variant.
+//
+// src must contain the whole skippable frame. Use IsSkippableFrame for checking
+// whether src starts with a skippable frame.
+func ReadSkippableFrame(dst, src []byte) ([]byte, uint32, error) {
+	if len(src) < C.ZSTD_SKIPPABLEHEADERSIZE {
+		return dst, 0, fmt.Errorf("too short skippable frame; got %d bytes; want at least %d bytes: %w",
+			len(src), C.ZSTD_SKIPPABLEHEADERSIZE, ErrSrcSizeWrong)
+	}
+	if !IsSkippableFrame(src) {
+		return dst, 0, fmt.Errorf("src doesn't start with skippable frame: %w", ErrUnknownFrame)
+	}
+
+	dstLen := len(dst)
+	n := binary.LittleEndian.Uint32(src[4:])
+	if uint64(n) > uint64(len(src)-C.ZSTD_SKIPPABLEHEADERSIZE) {
+		return dst, 0, fmt.Errorf("truncated skippable frame; got %d bytes of payload; want %d bytes: %w",
+			len(src)-C.ZSTD_SKIPPABLEHEADERSIZE, n, ErrSrcSizeWrong)
+	}
+	payloadSize := int(n)
+	if n := dstLen + payloadSize - cap(dst); n > 0 {
+		dst = append(dst[:cap(dst)], make([]byte, n)...)
+	}
+	dst = dst[:dstLen+payloadSize]
+
+	var dstPtr *byte
+	if payloadSize > 0 {
+		dstPtr = &dst[dstLen]
+	}
+	var magicVariant C.unsigned
+	result := C.ZSTD_readSkippableFrame_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(dstPtr))),
+		C.size_t(payloadSize),
+		&magicVariant,
+		C.uintptr_t(uintptr(unsafe.Pointer(&src[0]))),
+		C.size_t(len(src)))
+	// Prevent from GC'ing of dst and src during CGO call above.
+	runtime.KeepAlive(dst)
+	runtime.KeepAlive(src)
+	if err := newError(result); err != nil {
+		return dst[:dstLen], 0, fmt.Errorf("cannot read skippable frame: %w", err)
+	}
+	return dst, uint32(magicVariant), nil
+}
+
+func findFrameCompressedSize(src []byte) (int, error) {
+	result := C.ZSTD_findFrameCompressedSize_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(&src[0]))),
+		C.size_t(len(src)))
+	// Prevent from GC'ing of src during CGO call above.
+	runtime.KeepAlive(src)
+	if err := newError(result); err != nil {
+		return 0, err
+	}
+	return int(result), nil
+}
+
+// IsSkippableFrame returns true if src starts with a skippable frame.
+func IsSkippableFrame(src []byte) bool {
+	if len(src) == 0 {
+		return false
+	}
+	result := C.ZSTD_isSkippableFrame_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(&src[0]))),
+		C.size_t(len(src)))
+	// Prevent from GC'ing of src during CGO call above.
+	runtime.KeepAlive(src)
+	return result != 0
+}
+
+func getFrameContentSize(src []byte) uint64 {
+	result := C.ZSTD_getFrameContentSize_frame_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(&src[0]))),
+		C.size_t(len(src)))
+	// Prevent from GC'ing of src during CGO call above.
+	runtime.KeepAlive(src)
+	return uint64(result)
+}
@@ -0,0 +1,375 @@
+package gozstd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestParseFrameHeader(t *testing.T) {
+	src := []byte(newTestString(100*1024, 10))
+
+	// Frame with known content size and no checksum.
+	cd := Compress(nil, src)
+	fh, err := ParseFrameHeader(cd)
+	if err != nil {
+		t.Fatalf("cannot parse frame header: %s", err)
+	}
+	if fh.Type != FrameTypeZstd {
+		t.Fatalf("unexpected frame type; got %d; want %d", fh.Type, FrameTypeZstd)
+	}
+	if fh.ContentSize != uint64(len(src)) {
+		t.Fatalf("unexpected content size; got %d; want %d", fh.ContentSize, len(src))
+	}
+	if fh.WindowSize == 0 {
+		t.Fatalf("expecting non-zero window size")
+	}
+	if fh.BlockSizeMax <= 0 {
+		t.Fatalf("expecting positive block size max; got %d", fh.BlockSizeMax)
+	}
+	if fh.DictID != 0 {
+		t.Fatalf("unexpected dict id; got %d; want 0", fh.DictID)
+	}
+	if fh.HasChecksum {
+		t.Fatalf("unexpected checksum flag")
+	}
+	if fh.HeaderSize <= 0 || fh.HeaderSize > len(cd) {
+		t.Fatalf("unexpected header size %d", fh.HeaderSize)
+	}
+
+	// The header alone must be enough for parsing.
+	fh1, err := ParseFrameHeader(cd[:fh.HeaderSize])
+	if err != nil {
+		t.Fatalf("cannot parse frame header without the frame body: %s", err)
+	}
+	if fh1 != fh {
+		t.Fatalf("unexpected frame header; got %+v; want %+v", fh1, fh)
+	}
+
+	// Frame with unknown content size and checksum.
+	var bb bytes.Buffer
+	zw := NewWriterParams(&bb, &WriterParams{
+		CompressionLevel: 5,
+		WindowLog:        20,
+		NoContentSize:    true,
+	})
+	if err := testWriterExt(zw, string(src)); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	zw.Release()
+	fh, err = ParseFrameHeader(bb.Bytes())
+	if err != nil {
+		t.Fatalf("cannot parse frame header: %s", err)
+	}
+	if fh.ContentSize != ContentSizeUnknown {
+		t.Fatalf("unexpected content size; got %d; want %d", fh.ContentSize, ContentSizeUnknown)
+	}
+	if fh.WindowSize != 1<<20 {
+		t.Fatalf("unexpected window size; got %d; want %d", fh.WindowSize, 1<<20)
+	}
+
+	cp := NewCompressParams(3)
+	defer cp.Release()
+	if err := cp.SetChecksum(true); err != nil {
+		t.Fatalf("cannot enable checksum: %s", err)
+	}
+	cd, err = CompressWithParams(nil, src, cp)
+	if err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	fh, err = ParseFrameHeader(cd)
+	if err != nil {
+		t.Fatalf("cannot parse frame header: %s", err)
+	}
+	if !fh.HasChecksum {
+		t.Fatalf("missing checksum flag")
+	}
+}
+
+func TestParseFrameHeaderDictID(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf("sample %d for frame header", i)))
+	}
+	dict := BuildDict(samples, 8*1024)
+	cdict, err := NewCDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	defer cdict.Release()
+
+	cd := CompressDict(nil, []byte("sample 123 for frame header"), cdict)
+	fh, err := ParseFrameHeader(cd)
+	if err != nil {
+		t.Fatalf("cannot parse frame header: %s", err)
+	}
+	if fh.DictID == 0 {
+		t.Fatalf("expecting non-zero dict id")
+	}
+}
+
+func TestParseFrameHeaderSkippable(t *testing.T) {
+	// Skippable frame with magic variant 3 and 5 bytes of user data.
+	src := []byte{0x53, 0x2a, 0x4d, 0x18, 5, 0, 0, 0, 'h', 'e', 'l', 'l', 'o'}
+	fh, err := ParseFrameHeader(src)
+	if err != nil {
+		t.Fatalf("cannot parse skippable frame header: %s", err)
+	}
+	if fh.Type != FrameTypeSkippable {
+		t.Fatalf("unexpected frame type; got %d; want %d", fh.Type, FrameTypeSkippable)
+	}
+	if fh.ContentSize != 5 {
+		t.Fatalf("unexpected content size; got %d; want 5", fh.ContentSize)
+	}
+	if fh.MagicVariant != 3 {
+		t.Fatalf("unexpected magic variant; got %d; want 3", fh.MagicVariant)
+	}
+	if fh.HeaderSize != 8 {
+		t.Fatalf("unexpected header size; got %d; want 8", fh.HeaderSize)
+	}
+}
+
+func TestParseFrameHeaderError(t *testing.T) {
+	f := func(src []byte, errExpected error) {
+		t.Helper()
+		_, err := ParseFrameHeader(src)
+		if !errors.Is(err, errExpected) {
+			t.Fatalf("unexpected error for src=%X; got %v; want %v", src, err, errExpected)
+		}
+	}
+	f(nil, ErrSrcSizeWrong)
+	f([]byte("invalid frame"), ErrUnknownFrame)
+
+	cd := Compress(nil, []byte(newTestString(1024, 10)))
+	f(cd[:3], ErrSrcSizeWrong)
+	f(cd[:5], ErrSrcSizeWrong)
+}
+
+func TestFrameIterator(t *testing.T) {
+	var srcs [][]byte
+	var cd []byte
+	for i := 0; i < 5; i++ {
+		src := []byte(newTestString((i+1)*10000, 10))
+		srcs = append(srcs, src)
+		cd = Compress(cd, src)
+	}
+	// Append a skippable frame with magic variant 0.
+	skippable := []byte{0x50, 0x2a, 0x4d, 0x18, 3, 0, 0, 0, 'f', 'o', 'o'}
+	cd = append(cd, skippable...)
+
+	// Append a frame with unknown content size.
+	var bb bytes.Buffer
+	zw := NewWriterParams(&bb, &WriterParams{
+		NoContentSize: true,
+	})
+	if err := testWriterExt(zw, "foobar"); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	zw.Release()
+	cd = append(cd, bb.Bytes()...)
+
+	it := NewFrameIterator(cd)
+	offset := 0
+	for i, src := range srcs {
+		if !it.Next() {
+			t.Fatalf("missing frame #%d; err: %v", i, it.Err())
+		}
+		fi := it.Frame()
+		if fi.Offset != offset {
+			t.Fatalf("unexpected offset for frame #%d; got %d; want %d", i, fi.Offset, offset)
+		}
+		if fi.Type != FrameTypeZstd {
+			t.Fatalf("unexpected type for frame #%d; got %d; want %d", i, fi.Type, FrameTypeZstd)
+		}
+		if fi.DecompressedSize != uint64(len(src)) {
+			t.Fatalf("unexpected decompressed size for frame #%d; got %d; want %d", i, fi.DecompressedSize, len(src))
+		}
+		plainData, err := Decompress(nil, cd[fi.Offset:fi.Offset+fi.CompressedSize])
+		if err != nil {
+			t.Fatalf("cannot decompress frame #%d: %s", i, err)
+		}
+		if !bytes.Equal(plainData, src) {
+			t.Fatalf("unexpected data for frame #%d", i)
+		}
+		offset += fi.CompressedSize
+	}
+
+	if !it.Next() {
+		t.Fatalf("missing skippable frame; err: %v", it.Err())
+	}
+	fi := it.Frame()
+	expectedFI := FrameInfo{
+		Offset:         offset,
+		CompressedSize: len(skippable),
+		Type:           FrameTypeSkippable,
+	}
+	if fi != expectedFI {
+		t.Fatalf("unexpected skippable frame info; got %+v; want %+v", fi, expectedFI)
+	}
+	offset += fi.CompressedSize
+
+	if !it.Next() {
+		t.Fatalf("missing frame with unknown content size; err: %v", it.Err())
+	}
+	fi = it.Frame()
+	if fi.Offset != offset || fi.CompressedSize != bb.Len() || fi.DecompressedSize != ContentSizeUnknown {
+		t.Fatalf("unexpected frame info for frame with unknown content size: %+v", fi)
+	}
+
+	if it.Next() {
+		t.Fatalf("unexpected frame after the end: %+v", it.Frame())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	n, err := CountFrames(cd)
+	if err != nil {
+		t.Fatalf("cannot count frames: %s", err)
+	}
+	if n != len(srcs)+2 {
+		t.Fatalf("unexpected number of frames; got %d; want %d", n, len(srcs)+2)
+	}
+}
+
+func TestFrameIteratorTruncated(t *testing.T) {
+	frame := Compress(nil, []byte(newTestString(10000, 10)))
+	cd := append(append([]byte{}, frame...), frame[:len(frame)-1]...)
+
+	it := NewFrameIterator(cd)
+	if !it.Next() {
+		t.Fatalf("missing the first frame; err: %v", it.Err())
+	}
+	fi := it.Frame()
+	if it.Next() {
+		t.Fatalf("unexpected truncated frame: %+v", it.Frame())
+	}
+	if err := it.Err(); !errors.Is(err, ErrSrcSizeWrong) {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrSrcSizeWrong)
+	}
+	if validLen := fi.Offset + fi.CompressedSize; validLen != len(frame) {
+		t.Fatalf("unexpected length of valid data; got %d; want %d", validLen, len(frame))
+	}
+
+	if _, err := SplitFrames(cd); !errors.Is(err, ErrSrcSizeWrong) {
+		t.Fatalf("unexpected error from SplitFrames; got %v; want %v", err, ErrSrcSizeWrong)
+	}
+	if _, err := CountFrames(cd); !errors.Is(err, ErrSrcSizeWrong) {
+		t.Fatalf("unexpected error from CountFrames; got %v; want %v", err, ErrSrcSizeWrong)
+	}
+	if _, err := CountFrames([]byte("invalid data")); !errors.Is(err, ErrUnknownFrame) {
+		t.Fatalf("unexpected error for invalid data; got %v; want %v", err, ErrUnknownFrame)
+	}
+}
+
+func TestSplitFrames(t *testing.T) {
+	frames, err := SplitFrames(nil)
+	if err != nil {
+		t.Fatalf("unexpected error for empty src: %s", err)
+	}
+	if len(frames) != 0 {
+		t.Fatalf("unexpected frames for empty src: %d", len(frames))
+	}
+
+	var srcs []string
+	var cd []byte
+	for i := 0; i < 10; i++ {
+		src := fmt.Sprintf("frame number %d", i)
+		srcs = append(srcs, src)
+		cd = Compress(cd, []byte(src))
+	}
+	frames, err = SplitFrames(cd)
+	if err != nil {
+		t.Fatalf("cannot split frames: %s", err)
+	}
+	if len(frames) != len(srcs) {
+		t.Fatalf("unexpected number of frames; got %d; want %d", len(frames), len(srcs))
+	}
+	for i, frame := range frames {
+		plainData, err := Decompress(nil, frame)
+		if err != nil {
+			t.Fatalf("cannot decompress frame #%d: %s", i, err)
+		}
+		if string(plainData) != srcs[i] {
+			t.Fatalf("unexpected frame #%d; got %q; want %q", i, plainData, srcs[i])
+		}
+	}
+}
+
+func TestSkippableFrame(t *testing.T) {
+	f := func(magicVariant uint32, payload []byte) {
+		t.Helper()
+		prefix := []byte("prefix")
+		frame, err := AppendSkippableFrame(append([]byte{}, prefix...), magicVariant, payload)
+		if err != nil {
+			t.Fatalf("cannot append skippable frame: %s", err)
+		}
+		if !bytes.HasPrefix(frame, prefix) {
+			t.Fatalf("missing prefix in the result")
+		}
+		frame = frame[len(prefix):]
+		if !IsSkippableFrame(frame) {
+			t.Fatalf("expecting skippable frame")
+		}
+		fh, err := ParseFrameHeader(frame)
+		if err != nil {
+			t.Fatalf("cannot parse skippable frame header: %s", err)
+		}
+		if fh.Type != FrameTypeSkippable || fh.MagicVariant != magicVariant || fh.ContentSize != uint64(len(payload)) {
+			t.Fatalf("unexpected skippable frame header: %+v", fh)
+		}
+
+		result, mv, err := ReadSkippableFrame(append([]byte{}, prefix...), frame)
+		if err != nil {
+			t.Fatalf("cannot read skippable frame: %s", err)
+		}
+		if mv != magicVariant {
+			t.Fatalf("unexpected magic variant; got %d; want %d", mv, magicVariant)
+		}
+		if !bytes.HasPrefix(result, prefix) {
+			t.Fatalf("missing prefix in the read payload")
+		}
+		if !bytes.Equal(result[len(prefix):], payload) {
+			t.Fatalf("unexpected payload; got %q; want %q", result[len(prefix):], payload)
+		}
+
+		// Skippable frames must be ignored by the decompressor.
+		src := []byte("some data")
+		cd := Compress(nil, src)
+		cd = append(cd, frame...)
+		cd = Compress(cd, src)
+		plainData, err := Decompress(nil, cd)
+		if err != nil {
+			t.Fatalf("cannot decompress data with skippable frame: %s", err)
+		}
+		if string(plainData) != "some datasome data" {
+			t.Fatalf("unexpected decompressed data: %q", plainData)
+		}
+	}
+	f(0, nil)
+	f(1, []byte("foobar"))
+	f(MaxSkippableMagicVariant, []byte(newTestString(200*1024, 10)))
+}
+
+func TestSkippableFrameError(t *testing.T) {
+	if _, err := AppendSkippableFrame(nil, MaxSkippableMagicVariant+1, nil); !errors.Is(err, ErrParameterOutOfBound) {
+		t.Fatalf("unexpected error for too big magic variant; got %v; want %v", err, ErrParameterOutOfBound)
+	}
+
+	frame, err := AppendSkippableFrame(nil, 2, []byte("foobar"))
+	if err != nil {
+		t.Fatalf("cannot append skippable frame: %s", err)
+	}
+	f := func(src []byte, errExpected error) {
+		t.Helper()
+		_, _, err := ReadSkippableFrame(nil, src)
+		if !errors.Is(err, errExpected) {
+			t.Fatalf("unexpected error for src=%X; got %v; want %v", src, err, errExpected)
+		}
+	}
+	f(nil, ErrSrcSizeWrong)
+	f(frame[:5], ErrSrcSizeWrong)
+	f(frame[:len(frame)-1], ErrSrcSizeWrong)
+	f(Compress(nil, []byte("foobar")), ErrUnknownFrame)
+}
@@ -3,6 +3,10 @@ package gozstd
 /*
 #cgo CFLAGS: -O3
 
+// Build the vendored zstd with multithreaded compression support.
+#cgo CFLAGS: -DZSTD_MULTITHREAD
+#cgo !windows LDFLAGS: -pthread
+
 #define ZSTD_STATIC_LINKING_ONLY
 #include "zstd.h"
 #include "zstd_errors.h"
@@ -21,16 +25,24 @@ static size_t ZSTD_compress_usingCDict_wrapper(uintptr_t ctx, uintptr_t dst, siz
     return ZSTD_compress_usingCDict((ZSTD_CCtx*)ctx, (void*)dst, dstCapacity, (const void*)src, srcSize, (const ZSTD_CDict*)cdict);
 }
 
-static size_t ZSTD_decompressDCtx_wrapper(uintptr_t ctx, uintptr_t dst, size_t dstCapacity, uintptr_t src, size_t srcSize) {
+static size_t ZSTD_decompressDCtx_wrapper(uintptr_t ctx, uintptr_t dst, size_t dstCapacity, uintptr_t src, size_t srcSize, int ignoreChecksum) {
+    size_t result = ZSTD_DCtx_setParameter((ZSTD_DCtx*)ctx, ZSTD_d_forceIgnoreChecksum, ignoreChecksum);
+    if (ZSTD_isError(result)) {
+        return result;
+    }
     return ZSTD_decompressDCtx((ZSTD_DCtx*)ctx, (void*)dst, dstCapacity, (const void*)src, srcSize);
 }
 
-static size_t ZSTD_decompress_usingDDict_wrapper(uintptr_t ctx, uintptr_t dst, size_t dstCapacity, uintptr_t src, size_t srcSize, uintptr_t ddict) {
+static size_t ZSTD_decompress_usingDDict_wrapper(uintptr_t ctx, uintptr_t dst, size_t dstCapacity, uintptr_t src, size_t srcSize, uintptr_t ddict, int ignoreChecksum) {
+    size_t result = ZSTD_DCtx_setParameter((ZSTD_DCtx*)ctx, ZSTD_d_forceIgnoreChecksum, ignoreChecksum);
+    if (ZSTD_isError(result)) {
+        return result;
+    }
     return ZSTD_decompress_usingDDict((ZSTD_DCtx*)ctx, (void*)dst, dstCapacity, (const void*)src, srcSize, (const ZSTD_DDict*)ddict);
 }
 
-static unsigned long long ZSTD_getFrameContentSize_wrapper(uintptr_t src, size_t srcSize) {
-    return ZSTD_getFrameContentSize((const void*)src, srcSize);
+static unsigned long long ZSTD_findDecompressedSize_wrapper(uintptr_t src, size_t srcSize) {
+    return ZSTD_findDecompressedSize((const void*)src, srcSize);
 }
 */
 import "C"
@@ -46,26 +58,42 @@ import (
 // DefaultCompressionLevel is the default compression level.
 const DefaultCompressionLevel = 3 // Obtained from ZSTD_CLEVEL_DEFAULT.
 
+// MaxCompressionLevel is the maximum compression level.
+//
+// Levels above 19 require much more memory for both compressor
+// and decompressor. See WriterParams.WindowLog for details.
+const MaxCompressionLevel = 22 // Obtained from ZSTD_maxCLevel.
+
 // Compress appends compressed src to dst and returns the result.
 func Compress(dst, src []byte) []byte {
-	return compressDictLevel(dst, src, nil, DefaultCompressionLevel)
+	return mustCompressDictLevel(dst, src, nil, DefaultCompressionLevel)
 }
 
 // CompressLevel appends compressed src to dst and returns the result.
 //
 // The given compressionLevel is used for the compression.
 func CompressLevel(dst, src []byte, compressionLevel int) []byte {
-	return compressDictLevel(dst, src, nil, compressionLevel)
+	return mustCompressDictLevel(dst, src, nil, compressionLevel)
 }
 
 // CompressDict appends compressed src to dst and returns the result.
 //
 // The given dictionary is used for the compression.
 func CompressDict(dst, src []byte, cd *CDict) []byte {
-	return compressDictLevel(dst, src, cd, 0)
+	return mustCompressDictLevel(dst, src, cd, 0)
+}
+
+func mustCompressDictLevel(dst, src []byte, cd *CDict, compressionLevel int) []byte {
+	dst, err := compressDictLevel(dst, src, cd, compressionLevel)
+	if err != nil {
+		// Compression errors are impossible for valid input parameters,
+		// since out-of-range compression levels are clamped by zstd.
+		panic(fmt.Errorf("BUG: unexpected error during compression with cd=%p: %w", cd, err))
+	}
+	return dst
 }
 
-func compressDictLevel(dst, src []byte, cd *CDict, compressionLevel int) []byte {
+func compressDictLevel(dst, src []byte, cd *CDict, compressionLevel int) ([]byte, error) {
 	var cctx, cctxDict *cctxWrapper
 	if cd == nil {
 		cctx = cctxPool.Get().(*cctxWrapper)
@@ -73,14 +101,14 @@ func compressDictLevel(dst, src []byte, cd *CDict, compressionLevel int) []byte
 		cctxDict = cctxDictPool.Get().(*cctxWrapper)
 	}
 
-	dst = compress(cctx, cctxDict, dst, src, cd, compressionLevel)
+	dst, err := compress(cctx, cctxDict, dst, src, cd, compressionLevel)
 
 	if cd == nil {
 		cctxPool.Put(cctx)
 	} else {
 		cctxDictPool.Put(cctxDict)
 	}
-	return dst
+	return dst, err
 }
 
 var cctxPool = &sync.Pool{
@@ -109,23 +137,23 @@ type cctxWrapper struct {
 	cctx *C.ZSTD_CCtx
 }
 
-func compress(cctx, cctxDict *cctxWrapper, dst, src []byte, cd *CDict, compressionLevel int) []byte {
+func compress(cctx, cctxDict *cctxWrapper, dst, src []byte, cd *CDict, compressionLevel int) ([]byte, error) {
 	if len(src) == 0 {
-		return dst
+		return dst, nil
 	}
 
 	dstLen := len(dst)
 	if cap(dst) > dstLen {
 		// Fast path - try compressing without dst resize.
-		result := compressInternal(cctx, cctxDict, dst[dstLen:cap(dst)], src, cd, compressionLevel, false)
+		result := compressInternal(cctx, cctxDict, dst[dstLen:cap(dst)], src, cd, compressionLevel)
 		compressedSize := int(result)
 		if compressedSize >= 0 {
 			// All OK.
-			return dst[:dstLen+compressedSize]
+			return dst[:dstLen+compressedSize], nil
 		}
 		if C.ZSTD_getErrorCode(result) != C.ZSTD_error_dstSize_tooSmall {
 			// Unexpected error.
-			panic(fmt.Errorf("BUG: unexpected error during compression with cd=%p: %s", cd, errStr(result)))
+			return dst[:dstLen], fmt.Errorf("compression error: %w", newError(result))
 		}
 	}
 
@@ -136,17 +164,20 @@ func compress(cctx, cctxDict *cctxWrapper, dst, src []byte, cd *CDict, compressi
 		dst = append(dst[:cap(dst)], make([]byte, n)...)
 	}
 
-	result := compressInternal(cctx, cctxDict, dst[dstLen:dstLen+compressBound], src, cd, compressionLevel, true)
+	result := compressInternal(cctx, cctxDict, dst[dstLen:dstLen+compressBound], src, cd, compressionLevel)
+	if err := newError(result); err != nil {
+		return dst[:dstLen], fmt.Errorf("compression error: %w", err)
+	}
 	compressedSize := int(result)
 	dst = dst[:dstLen+compressedSize]
 	if cap(dst)-len(dst) > 4096 {
 		// Re-allocate dst in order to remove superflouos capacity and reduce memory usage.
 		dst = append([]byte{}, dst...)
 	}
-	return dst
+	return dst, nil
 }
 
-func compressInternal(cctx, cctxDict *cctxWrapper, dst, src []byte, cd *CDict, compressionLevel int, mustSucceed bool) C.size_t {
+func compressInternal(cctx, cctxDict *cctxWrapper, dst, src []byte, cd *CDict, compressionLevel int) C.size_t {
 	if cd != nil {
 		result := C.ZSTD_compress_usingCDict_wrapper(
 			C.uintptr_t(uintptr(unsafe.Pointer(cctxDict.cctx))),
@@ -158,9 +189,6 @@ func compressInternal(cctx, cctxDict *cctxWrapper, dst, src []byte, cd *CDict, c
 		// Prevent from GC'ing of dst and src during CGO call above.
 		runtime.KeepAlive(dst)
 		runtime.KeepAlive(src)
-		if mustSucceed {
-			ensureNoError("ZSTD_compress_usingCDict_wrapper", result)
-		}
 		return result
 	}
 	result := C.ZSTD_compressCCtx_wrapper(
@@ -173,13 +201,13 @@ func compressInternal(cctx, cctxDict *cctxWrapper, dst, src []byte, cd *CDict, c
 	// Prevent from GC'ing of dst and src during CGO call above.
 	runtime.KeepAlive(dst)
 	runtime.KeepAlive(src)
-	if mustSucceed {
-		ensureNoError("ZSTD_compressCCtx_wrapper", result)
-	}
 	return result
 }
 
 // Decompress appends decompressed src to dst and returns the result.
+//
+// Use DecompressWithOptions for limiting memory usage when decompressing
+// untrusted src.
 func Decompress(dst, src []byte) ([]byte, error) {
 	return DecompressDict(dst, src, nil)
 }
@@ -188,17 +216,80 @@ func Decompress(dst, src []byte) ([]byte, error) {
 //
 // The given dictionary dd is used for the decompression.
 func DecompressDict(dst, src []byte, dd *DDict) ([]byte, error) {
+	opts := DecompressOptions{
+		Dict: dd,
+	}
+	return decompressOptions(dst, src, opts)
+}
+
+// DecompressOptions allows limiting resources used by DecompressWithOptions.
+//
+// Use it when decompressing data from untrusted sources.
+type DecompressOptions struct {
+	// Dict is optional dictionary used for the decompression.
+	Dict *DDict
+
+	// MaxDecompressedSize is the maximum size of the decompressed data
+	// appended to dst. Special value 0 means 'no limit'.
+	//
+	// ErrDecompressedSizeTooLarge is returned if the limit is exceeded.
+	MaxDecompressedSize int64
+
+	// MaxWindowLog is the maximum windowLog accepted in frame headers.
+	// Special value 0 means 'no limit'.
+	//
+	// ErrWindowTooLarge is returned if the limit is exceeded.
+	//
+	// Frames without content size in their headers are decompressed
+	// in streaming mode, which accepts windowLog up to 27 by default.
+	// Set MaxWindowLog to WindowLog used for compressing such frames
+	// if it exceeds 27.
+	MaxWindowLog int
+
+	// SkipChecksum disables verification of content checksums stored
+	// in frames. By default the checksums are verified and ErrChecksumWrong
+	// is returned on mismatch.
+	SkipChecksum bool
+}
+
+// DecompressWithOptions appends decompressed src to dst and returns the result.
+//
+// Frame headers in src are verified against the limits from opts before
+// allocating memory for the decompressed data. Frames without content size
+// in their headers are decompressed in streaming mode until the limit
+// is reached.
+func DecompressWithOptions(dst, src []byte, opts *DecompressOptions) ([]byte, error) {
+	if opts == nil {
+		return Decompress(dst, src)
+	}
+	if err := checkDecompressOptions(opts); err != nil {
+		return dst, err
+	}
+	return decompressOptions(dst, src, *opts)
+}
+
+func checkDecompressOptions(opts *DecompressOptions) error {
+	if opts.MaxDecompressedSize < 0 {
+		return fmt.Errorf("MaxDecompressedSize cannot be negative; got %d", opts.MaxDecompressedSize)
+	}
+	if opts.MaxWindowLog < 0 || opts.MaxWindowLog > 63 {
+		return fmt.Errorf("MaxWindowLog must be in the range [0..63]; got %d: %w", opts.MaxWindowLog, ErrParameterOutOfBound)
+	}
+	return nil
+}
+
+func decompressOptions(dst, src []byte, opts DecompressOptions) ([]byte, error) {
 	var dctx, dctxDict *dctxWrapper
-	if dd == nil {
+	if opts.Dict == nil {
 		dctx = dctxPool.Get().(*dctxWrapper)
 	} else {
 		dctxDict = dctxDictPool.Get().(*dctxWrapper)
 	}
 
 	var err error
-	dst, err = decompress(dctx, dctxDict, dst, src, dd)
+	dst, err = decompress(dctx, dctxDict, &streamDecompressorPool, dst, src, opts)
 
-	if dd == nil {
+	if opts.Dict == nil {
 		dctxPool.Put(dctx)
 	} else {
 		dctxDictPool.Put(dctxDict)
@@ -232,15 +323,28 @@ type dctxWrapper struct {
 	dctx *C.ZSTD_DCtx
 }
 
-func decompress(dctx, dctxDict *dctxWrapper, dst, src []byte, dd *DDict) ([]byte, error) {
+func decompress(dctx, dctxDict *dctxWrapper, sdPool objectPool, dst, src []byte, opts DecompressOptions) ([]byte, error) {
 	if len(src) == 0 {
 		return dst, nil
 	}
 
+	dd := opts.Dict
+	maxSize := opts.MaxDecompressedSize
+	if maxSize > 0 || opts.MaxWindowLog > 0 {
+		if err := checkFrameLimits(src, opts); err != nil {
+			return dst, err
+		}
+	}
+
 	dstLen := len(dst)
 	if cap(dst) > dstLen {
 		// Fast path - try decompressing without dst resize.
-		result := decompressInternal(dctx, dctxDict, dst[dstLen:cap(dst)], src, dd)
+		dstEnd := cap(dst)
+		if maxSize > 0 && int64(dstEnd-dstLen) > maxSize {
+			// Do not decompress more than maxSize bytes.
+			dstEnd = dstLen + int(maxSize)
+		}
+		result := decompressInternal(dctx, dctxDict, dst[dstLen:dstEnd:dstEnd], src, dd, opts.SkipChecksum)
 		decompressedSize := int(result)
 		if decompressedSize >= 0 {
 			// All OK.
@@ -249,20 +353,22 @@ func decompress(dctx, dctxDict *dctxWrapper, dst, src []byte, dd *DDict) ([]byte
 
 		if C.ZSTD_getErrorCode(result) != C.ZSTD_error_dstSize_tooSmall {
 			// Error during decompression.
-			return dst[:dstLen], fmt.Errorf("decompression error: %s", errStr(result))
+			return dst[:dstLen], fmt.Errorf("decompression error: %w", newError(result))
 		}
 	}
 
 	// Slow path - resize dst to fit decompressed data.
-	decompressBound := int(C.ZSTD_getFrameContentSize_wrapper(
+	// The decompressed size is summed over all the frames in src,
+	// including skippable frames, which decompress into nothing.
+	decompressBound := int(C.ZSTD_findDecompressedSize_wrapper(
 		C.uintptr_t(uintptr(unsafe.Pointer(&src[0]))), C.size_t(len(src))))
 	// Prevent from GC'ing of src during CGO call above.
 	runtime.KeepAlive(src)
 	switch uint64(decompressBound) {
 	case uint64(C.ZSTD_CONTENTSIZE_UNKNOWN):
-		return streamDecompress(dst, src, dd)
+		return streamDecompress(sdPool, dst, src, opts)
 	case uint64(C.ZSTD_CONTENTSIZE_ERROR):
-		return dst, fmt.Errorf("cannot decompress invalid src")
+		return dst, fmt.Errorf("cannot decompress invalid src: %w", invalidSrcError(src))
 	}
 	decompressBound++
 
@@ -271,7 +377,7 @@ func decompress(dctx, dctxDict *dctxWrapper, dst, src []byte, dd *DDict) ([]byte
 		dst = append(dst[:cap(dst)], make([]byte, n)...)
 	}
 
-	result := decompressInternal(dctx, dctxDict, dst[dstLen:dstLen+decompressBound], src, dd)
+	result := decompressInternal(dctx, dctxDict, dst[dstLen:dstLen+decompressBound], src, dd, opts.SkipChecksum)
 	decompressedSize := int(result)
 	if decompressedSize >= 0 {
 		dst = dst[:dstLen+decompressedSize]
@@ -283,10 +389,14 @@ func decompress(dctx, dctxDict *dctxWrapper, dst, src []byte, dd *DDict) ([]byte
 	}
 
 	// Error during decompression.
-	return dst[:dstLen], fmt.Errorf("decompression error: %s", errStr(result))
+	return dst[:dstLen], fmt.Errorf("decompression error: %w", newError(result))
 }
 
-func decompressInternal(dctx, dctxDict *dctxWrapper, dst, src []byte, dd *DDict) C.size_t {
+func decompressInternal(dctx, dctxDict *dctxWrapper, dst, src []byte, dd *DDict, skipChecksum bool) C.size_t {
+	ignoreChecksum := C.ZSTD_d_validateChecksum
+	if skipChecksum {
+		ignoreChecksum = C.ZSTD_d_ignoreChecksum
+	}
 	var n C.size_t
 	if dd != nil {
 		n = C.ZSTD_decompress_usingDDict_wrapper(
@@ -295,14 +405,16 @@ func decompressInternal(dctx, dctxDict *dctxWrapper, dst, src []byte, dd *DDict)
 			C.size_t(cap(dst)),
 			C.uintptr_t(uintptr(unsafe.Pointer(&src[0]))),
 			C.size_t(len(src)),
-			C.uintptr_t(uintptr(unsafe.Pointer(dd.p))))
+			C.uintptr_t(uintptr(unsafe.Pointer(dd.p))),
+			C.int(ignoreChecksum))
 	} else {
 		n = C.ZSTD_decompressDCtx_wrapper(
 			C.uintptr_t(uintptr(unsafe.Pointer(dctx.dctx))),
 			C.uintptr_t(uintptr(unsafe.Pointer(&dst[0]))),
 			C.size_t(cap(dst)),
 			C.uintptr_t(uintptr(unsafe.Pointer(&src[0]))),
-			C.size_t(len(src)))
+			C.size_t(len(src)),
+			C.int(ignoreChecksum))
 	}
 	// Prevent from GC'ing of dst and src during CGO calls above.
 	runtime.KeepAlive(dst)
@@ -310,29 +422,76 @@ func decompressInternal(dctx, dctxDict *dctxWrapper, dst, src []byte, dd *DDict)
 	return n
 }
 
-func errStr(result C.size_t) string {
-	errCode := C.ZSTD_getErrorCode(result)
-	errCStr := C.ZSTD_getErrorString(errCode)
-	return C.GoString(errCStr)
+func ensureNoError(funcName string, result C.size_t) {
+	if err := newError(result); err != nil {
+		panic(fmt.Errorf("BUG: unexpected error in %s: %w", funcName, err))
+	}
 }
 
-func ensureNoError(funcName string, result C.size_t) {
-	if int(result) >= 0 {
-		// Fast path - avoid calling C function.
-		return
+// checkFrameLimits verifies headers for all the frames in src against
+// the limits from opts.
+func checkFrameLimits(src []byte, opts DecompressOptions) error {
+	var maxWindowSize uint64
+	if opts.MaxWindowLog > 0 {
+		maxWindowSize = uint64(1) << uint(opts.MaxWindowLog)
 	}
-	if C.ZSTD_getErrorCode(result) != 0 {
-		panic(fmt.Errorf("BUG: unexpected error in %s: %s", funcName, errStr(result)))
+	maxSize := uint64(opts.MaxDecompressedSize)
+	totalSize := uint64(0)
+
+	offset := 0
+	for offset < len(src) {
+		frame := src[offset:]
+		fh, err := ParseFrameHeader(frame)
+		if err != nil {
+			return fmt.Errorf("cannot parse frame header at offset %d: %w", offset, err)
+		}
+		if fh.Type == FrameTypeZstd {
+			if maxWindowSize > 0 && fh.WindowSize > maxWindowSize {
+				return fmt.Errorf("frame at offset %d requires window size %d exceeding the limit %d: %w",
+					offset, fh.WindowSize, maxWindowSize, ErrWindowTooLarge)
+			}
+			if maxSize > 0 && fh.ContentSize != ContentSizeUnknown {
+				if fh.ContentSize > maxSize-totalSize {
+					return fmt.Errorf("frame at offset %d has content size %d exceeding the limit %d: %w",
+						offset, fh.ContentSize, maxSize, ErrDecompressedSizeTooLarge)
+				}
+				totalSize += fh.ContentSize
+			}
+		}
+
+		frameSize, err := findFrameCompressedSize(frame)
+		if err != nil {
+			return fmt.Errorf("cannot find frame size at offset %d: %w", offset, err)
+		}
+		offset += frameSize
 	}
+	return nil
 }
 
-func streamDecompress(dst, src []byte, dd *DDict) ([]byte, error) {
-	sd := getStreamDecompressor(dd)
+func streamDecompress(sdPool objectPool, dst, src []byte, opts DecompressOptions) ([]byte, error) {
+	params := ReaderParams{
+		MaxDecompressedSize: opts.MaxDecompressedSize,
+		Dict:                opts.Dict,
+		SkipChecksum:        opts.SkipChecksum,
+	}
+	if opts.MaxWindowLog > 0 {
+		// Frames exceeding MaxWindowLog are already rejected
+		// by checkFrameLimits, so just clamp it to the bounds
+		// accepted by the decompressor.
+		params.MaxWindowLog = opts.MaxWindowLog
+		if params.MaxWindowLog < WindowLogMin {
+			params.MaxWindowLog = WindowLogMin
+		}
+		if params.MaxWindowLog > WindowLogMax {
+			params.MaxWindowLog = WindowLogMax
+		}
+	}
+	sd := getStreamDecompressor(sdPool, &params)
 	sd.dst = dst
 	sd.src = src
 	_, err := sd.zr.WriteTo(sd)
 	dst = sd.dst
-	putStreamDecompressor(sd)
+	putStreamDecompressor(sdPool, sd)
 	return dst, err
 }
 
@@ -361,8 +520,14 @@ func (sd *streamDecompressor) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
-func getStreamDecompressor(dd *DDict) *streamDecompressor {
-	v := streamDecompressorPool.Get()
+// objectPool is a pool of reusable objects such as sync.Pool.
+type objectPool interface {
+	Get() interface{}
+	Put(v interface{})
+}
+
+func getStreamDecompressor(sdPool objectPool, params *ReaderParams) *streamDecompressor {
+	v := sdPool.Get()
 	if v == nil {
 		sd := &streamDecompressor{
 			zr: NewReader(nil),
@@ -370,16 +535,16 @@ func getStreamDecompressor(dd *DDict) *streamDecompressor {
 		v = sd
 	}
 	sd := v.(*streamDecompressor)
-	sd.zr.Reset((*srcReader)(sd), dd)
+	sd.zr.ResetReaderParams((*srcReader)(sd), params)
 	return sd
 }
 
-func putStreamDecompressor(sd *streamDecompressor) {
+func putStreamDecompressor(sdPool objectPool, sd *streamDecompressor) {
 	sd.dst = nil
 	sd.src = nil
 	sd.srcOffset = 0
-	sd.zr.Reset(nil, nil)
-	streamDecompressorPool.Put(sd)
+	sd.zr.ResetReaderParams(nil, &ReaderParams{})
+	sdPool.Put(sd)
 }
 
 var streamDecompressorPool sync.Pool
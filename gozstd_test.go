@@ -3,6 +3,7 @@ package gozstd
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/rand"
 	"runtime"
@@ -357,3 +358,148 @@ func TestCompressDecompressMultiFrames(t *testing.T) {
 			plainData, origData, len(plainData), len(origData))
 	}
 }
+
+func TestDecompressWithOptions(t *testing.T) {
+	data := []byte(newTestString(64*1024, 3))
+
+	// Frame with known content size.
+	cd := Compress(nil, data)
+	testDecompressWithOptionsSuccess(t, cd, data, &DecompressOptions{})
+	testDecompressWithOptionsSuccess(t, cd, data, &DecompressOptions{MaxDecompressedSize: int64(len(data))})
+	testDecompressWithOptionsError(t, cd, &DecompressOptions{MaxDecompressedSize: int64(len(data)) - 1}, ErrDecompressedSizeTooLarge)
+
+	// Concatenated frames must be limited by their total size.
+	cdMulti := append(append([]byte{}, cd...), cd...)
+	testDecompressWithOptionsError(t, cdMulti, &DecompressOptions{MaxDecompressedSize: int64(len(data)) + 1}, ErrDecompressedSizeTooLarge)
+
+	// Frame with unknown content size.
+	var bb bytes.Buffer
+	zw := NewWriterParams(&bb, &WriterParams{WindowLog: 20})
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close zw: %s", err)
+	}
+	zw.Release()
+	cd = bb.Bytes()
+	testDecompressWithOptionsSuccess(t, cd, data, &DecompressOptions{MaxDecompressedSize: int64(len(data)), MaxWindowLog: 20})
+	testDecompressWithOptionsError(t, cd, &DecompressOptions{MaxDecompressedSize: int64(len(data)) - 1}, ErrDecompressedSizeTooLarge)
+	testDecompressWithOptionsError(t, cd, &DecompressOptions{MaxWindowLog: 19}, ErrWindowTooLarge)
+
+	// Invalid options.
+	if _, err := DecompressWithOptions(nil, cd, &DecompressOptions{MaxWindowLog: 64}); !errors.Is(err, ErrParameterOutOfBound) {
+		t.Fatalf("unexpected error for invalid MaxWindowLog; got %v; want %v", err, ErrParameterOutOfBound)
+	}
+}
+
+func TestDecompressWithOptionsBigWindow(t *testing.T) {
+	const wlog = 28
+	data := []byte(newTestString(64*1024, 3))
+
+	// Frame with unknown content size and the window exceeding the default limit.
+	var bb bytes.Buffer
+	zw := NewWriterParams(&bb, &WriterParams{
+		WindowLog:            wlog,
+		LongDistanceMatching: ParamSwitchEnable,
+	})
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close zw: %s", err)
+	}
+	zw.Release()
+	cd := bb.Bytes()
+
+	if _, err := Decompress(nil, cd); !errors.Is(err, ErrWindowTooLarge) {
+		t.Fatalf("unexpected error with the default window limit; got %v; want %v", err, ErrWindowTooLarge)
+	}
+	testDecompressWithOptionsSuccess(t, cd, data, &DecompressOptions{MaxWindowLog: wlog})
+	testDecompressWithOptionsSuccess(t, cd, data, &DecompressOptions{MaxWindowLog: 40})
+	testDecompressWithOptionsError(t, cd, &DecompressOptions{MaxWindowLog: wlog - 1}, ErrWindowTooLarge)
+}
+
+func testDecompressWithOptionsSuccess(t *testing.T, cd, data []byte, opts *DecompressOptions) {
+	t.Helper()
+
+	plainData, err := DecompressWithOptions(nil, cd, opts)
+	if err != nil {
+		t.Fatalf("unexpected error with %+v: %s", opts, err)
+	}
+	if !bytes.Equal(plainData, data) {
+		t.Fatalf("unexpected data decompressed with %+v; got\n%X; want\n%X", opts, plainData, data)
+	}
+
+	// Decompress into a buffer with big capacity.
+	buf := make([]byte, 0, 4*len(data))
+	plainData, err = DecompressWithOptions(buf, cd, opts)
+	if err != nil {
+		t.Fatalf("unexpected error with %+v into big buffer: %s", opts, err)
+	}
+	if !bytes.Equal(plainData, data) {
+		t.Fatalf("unexpected data decompressed with %+v into big buffer; got\n%X; want\n%X", opts, plainData, data)
+	}
+}
+
+func testDecompressWithOptionsError(t *testing.T, cd []byte, opts *DecompressOptions, errExpected error) {
+	t.Helper()
+
+	prefix := []byte("prefix")
+	dst, err := DecompressWithOptions(prefix, cd, opts)
+	if !errors.Is(err, errExpected) {
+		t.Fatalf("unexpected error with %+v; got %v; want %v", opts, err, errExpected)
+	}
+	if string(dst) != string(prefix) {
+		t.Fatalf("unexpected dst on error; got %q; want %q", dst, prefix)
+	}
+
+	// Decompress into a buffer with big capacity.
+	buf := make([]byte, 0, 4*len(cd)+1024*1024)
+	if _, err := DecompressWithOptions(buf, cd, opts); !errors.Is(err, errExpected) {
+		t.Fatalf("unexpected error with %+v into big buffer; got %v; want %v", opts, err, errExpected)
+	}
+}
+
+func TestDecompressChecksum(t *testing.T) {
+	data := []byte(newTestString(64*1024, 3))
+
+	// Frame with content size.
+	cp := NewCompressParams(DefaultCompressionLevel)
+	defer cp.Release()
+	if err := cp.SetChecksum(true); err != nil {
+		t.Fatalf("cannot enable checksum: %s", err)
+	}
+	cd, err := CompressWithParams(nil, data, cp)
+	if err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	testDecompressChecksum(t, cd, data)
+
+	// Frame without content size.
+	var bb bytes.Buffer
+	zw := NewWriterParams(&bb, &WriterParams{Checksum: true, NoContentSize: true})
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close zw: %s", err)
+	}
+	zw.Release()
+	testDecompressChecksum(t, bb.Bytes(), data)
+}
+
+func testDecompressChecksum(t *testing.T, cd, data []byte) {
+	t.Helper()
+
+	testDecompressWithOptionsSuccess(t, cd, data, &DecompressOptions{})
+
+	// Corrupt the checksum at the end of the frame.
+	cd = append([]byte{}, cd...)
+	cd[len(cd)-1]++
+	if _, err := Decompress(nil, cd); !errors.Is(err, ErrChecksumWrong) {
+		t.Fatalf("unexpected error for corrupted checksum; got %v; want %v", err, ErrChecksumWrong)
+	}
+	testDecompressWithOptionsError(t, cd, &DecompressOptions{}, ErrChecksumWrong)
+	testDecompressWithOptionsSuccess(t, cd, data, &DecompressOptions{SkipChecksum: true})
+}
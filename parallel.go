@@ -0,0 +1,259 @@
+package gozstd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// DefaultParallelChunkSize is the default size of uncompressed data
+// in a single frame written by ParallelWriter.
+const DefaultParallelChunkSize = 1 << 20
+
+// A ParallelWriterParams allows users to specify compression parameters
+// by calling NewParallelWriter.
+//
+// Calling NewParallelWriter with a nil ParallelWriterParams is equivalent
+// to using the default parameters.
+type ParallelWriterParams struct {
+	// Compression level. Special value 0 means 'default compression level'.
+	CompressionLevel int
+
+	// Dict is optional dictionary used for compression.
+	Dict *CDict
+
+	// ChunkSize is the size of uncompressed data in every frame except
+	// the last one and the frames finished by Flush.
+	// Special value 0 means DefaultParallelChunkSize.
+	//
+	// Smaller chunks improve concurrency for small streams at the cost
+	// of compression ratio.
+	ChunkSize int
+
+	// Concurrency is the maximum number of chunks compressed concurrently.
+	// Special value 0 means runtime.GOMAXPROCS(0).
+	Concurrency int
+}
+
+// ParallelWriter implements zstd writer, which compresses the written data
+// in multiple goroutines.
+//
+// The data is split into chunks of ParallelWriterParams.ChunkSize bytes.
+// The chunks are compressed concurrently into independent frames, which are
+// written to the underlying writer in order. The output may be decompressed
+// with Reader or Decompress.
+//
+// ParallelWriter holds up to ParallelWriterParams.Concurrency chunks
+// together with their compressed data in memory.
+//
+// If an error occurs while writing to a ParallelWriter, no more data will
+// be accepted and all the subsequent calls to Write, Flush and Close will
+// return the error.
+type ParallelWriter struct {
+	w                io.Writer
+	cd               *CDict
+	compressionLevel int
+	chunkSize        int
+	concurrency      int
+
+	// cur is the chunk accumulating the written data.
+	cur *parallelChunk
+
+	// queue contains the chunks being compressed in the order of writing.
+	queue []*parallelChunk
+
+	// free contains the chunks, which may be reused.
+	free []*parallelChunk
+
+	err error
+}
+
+type parallelChunk struct {
+	src []byte
+	dst []byte
+	err error
+
+	// done receives a value when the chunk is compressed.
+	done chan struct{}
+}
+
+// NewParallelWriter returns new zstd writer writing compressed data to w
+// using the given set of parameters.
+//
+// The returned writer must be closed with Close call in order
+// to flush the compressed data.
+//
+// Invalid params result in error returned from the first Write, Flush
+// or Close call.
+//
+// Call Release when the ParallelWriter is no longer needed.
+func NewParallelWriter(w io.Writer, params *ParallelWriterParams) *ParallelWriter {
+	if params == nil {
+		params = &ParallelWriterParams{}
+	}
+	chunkSize := params.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = DefaultParallelChunkSize
+	}
+	concurrency := params.Concurrency
+	if concurrency == 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	pw := &ParallelWriter{
+		w:                w,
+		cd:               params.Dict,
+		compressionLevel: params.CompressionLevel,
+		chunkSize:        chunkSize,
+		concurrency:      concurrency,
+	}
+	if chunkSize < 0 {
+		pw.err = fmt.Errorf("ChunkSize cannot be negative; got %d", chunkSize)
+	} else if concurrency < 0 {
+		pw.err = fmt.Errorf("Concurrency cannot be negative; got %d", concurrency)
+	}
+	return pw
+}
+
+// Write writes p to pw.
+//
+// Write doesn't flush the compressed data to the underlying writer
+// until ParallelWriterParams.Concurrency chunks are compressed.
+// Call Flush or Close when the compressed data must propagate
+// to the underlying writer.
+func (pw *ParallelWriter) Write(p []byte) (int, error) {
+	if pw.err != nil {
+		return 0, pw.err
+	}
+	nn := 0
+	for len(p) > 0 {
+		if pw.cur == nil {
+			pw.cur = pw.getChunk()
+		}
+		n := pw.chunkSize - len(pw.cur.src)
+		if n > len(p) {
+			n = len(p)
+		}
+		pw.cur.src = append(pw.cur.src, p[:n]...)
+		nn += n
+		p = p[n:]
+		if len(pw.cur.src) == pw.chunkSize {
+			if err := pw.compressChunk(); err != nil {
+				return nn, err
+			}
+		}
+	}
+	return nn, nil
+}
+
+// Flush compresses the buffered data and writes all the compressed data
+// to the underlying writer.
+//
+// Flush ends the current frame, so frequent Flush calls worsen
+// the compression ratio.
+func (pw *ParallelWriter) Flush() error {
+	if pw.err != nil {
+		return pw.err
+	}
+	if pw.cur != nil {
+		if err := pw.compressChunk(); err != nil {
+			return err
+		}
+	}
+	for len(pw.queue) > 0 {
+		if err := pw.writeChunk(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close flushes all the compressed data to the underlying writer.
+//
+// It doesn't close the underlying writer.
+// pw cannot be written to after Close.
+func (pw *ParallelWriter) Close() error {
+	if err := pw.Flush(); err != nil {
+		return err
+	}
+	pw.err = errors.New("cannot write to closed ParallelWriter")
+	return nil
+}
+
+// Release releases all the resources occupied by pw.
+//
+// It waits until the chunks being compressed are done.
+// pw cannot be used after the release.
+func (pw *ParallelWriter) Release() {
+	for _, pc := range pw.queue {
+		<-pc.done
+	}
+	pw.w = nil
+	pw.cd = nil
+	pw.cur = nil
+	pw.queue = nil
+	pw.free = nil
+	pw.err = nil
+}
+
+func (pw *ParallelWriter) getChunk() *parallelChunk {
+	if n := len(pw.free); n > 0 {
+		pc := pw.free[n-1]
+		pw.free = pw.free[:n-1]
+		return pc
+	}
+	return &parallelChunk{
+		src:  make([]byte, 0, pw.chunkSize),
+		dst:  make([]byte, 0, CompressBound(pw.chunkSize)),
+		done: make(chan struct{}, 1),
+	}
+}
+
+// compressChunk starts compressing pw.cur in a new goroutine.
+func (pw *ParallelWriter) compressChunk() error {
+	if len(pw.queue) >= pw.concurrency {
+		// Limit the number of chunks in memory.
+		if err := pw.writeChunk(); err != nil {
+			return err
+		}
+	}
+	pc := pw.cur
+	pw.cur = nil
+	pw.queue = append(pw.queue, pc)
+	go compressParallelChunk(pc, pw.cd, pw.compressionLevel)
+	return nil
+}
+
+func compressParallelChunk(pc *parallelChunk, cd *CDict, compressionLevel int) {
+	pc.dst, pc.err = compressDictLevel(pc.dst[:0], pc.src, cd, compressionLevel)
+	pc.done <- struct{}{}
+}
+
+// writeChunk waits until the first chunk in the queue is compressed
+// and writes it to the underlying writer.
+func (pw *ParallelWriter) writeChunk() error {
+	pc := pw.queue[0]
+	<-pc.done
+	pw.queue = append(pw.queue[:0], pw.queue[1:]...)
+	dst, err := pc.dst, pc.err
+	pc.src = pc.src[:0]
+	pc.err = nil
+	if err != nil {
+		pw.free = append(pw.free, pc)
+		pw.err = fmt.Errorf("cannot compress chunk: %w", err)
+		return pw.err
+	}
+
+	n, err := pw.w.Write(dst)
+	pw.free = append(pw.free, pc)
+	if err == nil && n != len(dst) {
+		// The underlying writer violated io.Writer contract and didn't return error
+		// after writing incomplete data.
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		pw.err = fmt.Errorf("cannot write compressed data to the underlying writer: %w", err)
+		return pw.err
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package gozstd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestParallelWriter(t *testing.T) {
+	const chunkSize = 64 * 1024
+	for _, dataSize := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 10*chunkSize + 123} {
+		for _, concurrency := range []int{1, 2, 7} {
+			data := newTestString(dataSize, 3)
+			var bb bytes.Buffer
+			pw := NewParallelWriter(&bb, &ParallelWriterParams{
+				ChunkSize:   chunkSize,
+				Concurrency: concurrency,
+			})
+			if err := testParallelWriterWrite(pw, data); err != nil {
+				t.Fatalf("cannot write data of size %d with concurrency=%d: %s", dataSize, concurrency, err)
+			}
+			if err := pw.Close(); err != nil {
+				t.Fatalf("cannot close pw: %s", err)
+			}
+			if _, err := pw.Write([]byte("foo")); err == nil {
+				t.Fatalf("expecting non-nil error when writing to closed pw")
+			}
+			pw.Release()
+
+			cd := bb.Bytes()
+			chunks, err := SplitFrames(cd)
+			if err != nil {
+				t.Fatalf("cannot split frames: %s", err)
+			}
+			if n := (dataSize + chunkSize - 1) / chunkSize; len(chunks) != n {
+				t.Fatalf("unexpected number of frames for data of size %d; got %d; want %d", dataSize, len(chunks), n)
+			}
+			plainData, err := Decompress(nil, cd)
+			if err != nil {
+				t.Fatalf("cannot decompress data of size %d: %s", dataSize, err)
+			}
+			if string(plainData) != data {
+				t.Fatalf("unexpected data decompressed for data of size %d", dataSize)
+			}
+
+			zr := NewReader(bytes.NewReader(cd))
+			plainData, err = ioutil.ReadAll(zr)
+			if err != nil {
+				t.Fatalf("cannot read data of size %d: %s", dataSize, err)
+			}
+			if string(plainData) != data {
+				t.Fatalf("unexpected data read for data of size %d", dataSize)
+			}
+			zr.Release()
+		}
+	}
+}
+
+func testParallelWriterWrite(pw *ParallelWriter, data string) error {
+	// Write data in chunks of random sizes.
+	for len(data) > 0 {
+		n := rand.Intn(200 * 1024)
+		if n > len(data) {
+			n = len(data)
+		}
+		nn, err := pw.Write([]byte(data[:n]))
+		if err != nil {
+			return err
+		}
+		if nn != n {
+			return fmt.Errorf("unexpected number of bytes written; got %d; want %d", nn, n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func TestParallelWriterFlush(t *testing.T) {
+	var bb bytes.Buffer
+	pw := NewParallelWriter(&bb, &ParallelWriterParams{CompressionLevel: 5})
+	defer pw.Release()
+
+	var data []byte
+	for i := 0; i < 5; i++ {
+		s := []byte(fmt.Sprintf("line #%d\n", i))
+		if _, err := pw.Write(s); err != nil {
+			t.Fatalf("cannot write data: %s", err)
+		}
+		data = append(data, s...)
+		if err := pw.Flush(); err != nil {
+			t.Fatalf("cannot flush data: %s", err)
+		}
+
+		// The flushed data must be decompressible.
+		plainData, err := Decompress(nil, bb.Bytes())
+		if err != nil {
+			t.Fatalf("cannot decompress flushed data: %s", err)
+		}
+		if !bytes.Equal(plainData, data) {
+			t.Fatalf("unexpected data decompressed; got %q; want %q", plainData, data)
+		}
+	}
+
+	// Flush without new data mustn't write anything.
+	n := bb.Len()
+	if err := pw.Flush(); err != nil {
+		t.Fatalf("cannot flush data: %s", err)
+	}
+	if bb.Len() != n {
+		t.Fatalf("unexpected data written by empty Flush")
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatalf("cannot close pw: %s", err)
+	}
+}
+
+func TestParallelWriterDict(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 1e4; i++ {
+		samples = append(samples, []byte(fmt.Sprintf("sample #%d, value=%d", i, i%100)))
+	}
+	dict := BuildDict(samples, 8*1024)
+	cd, err := NewCDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	defer cd.Release()
+	dd, err := NewDDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create DDict: %s", err)
+	}
+	defer dd.Release()
+
+	data := newTestString(300*1024, 3)
+	var bb bytes.Buffer
+	pw := NewParallelWriter(&bb, &ParallelWriterParams{
+		Dict:      cd,
+		ChunkSize: 32 * 1024,
+	})
+	defer pw.Release()
+	if err := testParallelWriterWrite(pw, data); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatalf("cannot close pw: %s", err)
+	}
+	plainData, err := DecompressDict(nil, bb.Bytes(), dd)
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if string(plainData) != data {
+		t.Fatalf("unexpected data decompressed")
+	}
+}
+
+func TestParallelWriterWriteError(t *testing.T) {
+	data := newTestString(1024*1024, 3)
+
+	errWriter := errors.New("cannot write")
+	pw := NewParallelWriter(&errorWriter{err: errWriter}, &ParallelWriterParams{
+		ChunkSize:   16 * 1024,
+		Concurrency: 3,
+	})
+	defer pw.Release()
+	if _, err := pw.Write([]byte(data)); !errors.Is(err, errWriter) {
+		t.Fatalf("unexpected error in Write; got %v; want %v", err, errWriter)
+	}
+	// The error must be sticky.
+	if err := pw.Close(); !errors.Is(err, errWriter) {
+		t.Fatalf("unexpected error in Close; got %v; want %v", err, errWriter)
+	}
+
+	pw = NewParallelWriter(&shortWriter{}, nil)
+	defer pw.Release()
+	if _, err := pw.Write([]byte(data)); err != nil {
+		t.Fatalf("unexpected error in Write: %s", err)
+	}
+	if err := pw.Close(); !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("unexpected error in Close; got %v; want %v", err, io.ErrShortWrite)
+	}
+}
+
+func TestParallelWriterInvalidParams(t *testing.T) {
+	for _, params := range []*ParallelWriterParams{
+		{ChunkSize: -1},
+		{Concurrency: -1},
+	} {
+		pw := NewParallelWriter(ioutil.Discard, params)
+		if _, err := pw.Write([]byte("foo")); err == nil {
+			t.Fatalf("expecting non-nil error for %+v", params)
+		}
+		if err := pw.Close(); err == nil {
+			t.Fatalf("expecting non-nil error on Close for %+v", params)
+		}
+		pw.Release()
+	}
+}
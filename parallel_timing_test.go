@@ -0,0 +1,43 @@
+package gozstd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func BenchmarkParallelWriter(b *testing.B) {
+	for _, blockSize := range benchLargeBlockSizes {
+		b.Run(fmt.Sprintf("blockSize_%d", blockSize), func(b *testing.B) {
+			for _, concurrency := range []int{1, 4} {
+				b.Run(fmt.Sprintf("concurrency_%d", concurrency), func(b *testing.B) {
+					benchmarkParallelWriter(b, blockSize, concurrency)
+				})
+			}
+		})
+	}
+}
+
+func benchmarkParallelWriter(b *testing.B, blockSize, concurrency int) {
+	block := newBenchString(blockSize * benchBlocksPerStream)
+	params := &ParallelWriterParams{
+		CompressionLevel: 1,
+		Concurrency:      concurrency,
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(block)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pw := NewParallelWriter(ioutil.Discard, params)
+		for i := 0; i < benchBlocksPerStream; i++ {
+			_, err := pw.Write(block[i*blockSize : (i+1)*blockSize])
+			if err != nil {
+				panic(fmt.Errorf("unexpected error: %s", err))
+			}
+		}
+		if err := pw.Close(); err != nil {
+			panic(fmt.Errorf("unexpected error: %s", err))
+		}
+		pw.Release()
+	}
+}
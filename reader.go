@@ -23,6 +23,10 @@ static size_t ZSTD_initDStream_usingDDict_wrapper(uintptr_t ds, uintptr_t dict)
     return ZSTD_DCtx_refDDict(zds, (ZSTD_DDict *)dict);
 }
 
+static size_t ZSTD_DCtx_setParameter_wrapper(uintptr_t ds, ZSTD_dParameter param, int value) {
+    return ZSTD_DCtx_setParameter((ZSTD_DStream*)ds, param, value);
+}
+
 static size_t ZSTD_freeDStream_wrapper(uintptr_t ds) {
     return ZSTD_freeDStream((ZSTD_DStream*)ds);
 }
@@ -30,10 +34,17 @@ static size_t ZSTD_freeDStream_wrapper(uintptr_t ds) {
 static size_t ZSTD_decompressStream_wrapper(uintptr_t ds, uintptr_t output, uintptr_t input) {
     return ZSTD_decompressStream((ZSTD_DStream*)ds, (ZSTD_outBuffer*)output, (ZSTD_inBuffer*)input);
 }
+
+static size_t ZSTD_decompressStream_simpleArgs_wrapper(uintptr_t ds, uintptr_t dst, size_t dstCapacity, uintptr_t dstPos, uintptr_t input) {
+    ZSTD_inBuffer* in = (ZSTD_inBuffer*)input;
+    return ZSTD_decompressStream_simpleArgs((ZSTD_DStream*)ds, (void*)dst, dstCapacity, (size_t*)dstPos, in->src, in->size, &in->pos);
+}
 */
 import "C"
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"runtime"
@@ -46,23 +57,56 @@ var (
 )
 
 // Reader implements zstd reader.
+//
+// Read and WriteTo return an error wrapping io.ErrUnexpectedEOF if
+// the compressed data ends in the middle of a frame.
 type Reader struct {
-	r  io.Reader
-	ds *C.ZSTD_DStream
-	dd *DDict
+	r            io.Reader
+	ds           *C.ZSTD_DStream
+	dd           *DDict
+	wlogMax      int
+	maxSize      int64
+	skipChecksum bool
+	singleFrame  bool
+	ctx          context.Context
+	decompressed int64
+
+	// bytesRead is the number of bytes read from r.
+	bytesRead int64
+
+	// srcSizeHint is the number of input bytes zstd needs for making
+	// progress. It limits reads from r in single-frame mode.
+	srcSizeHint C.size_t
+
+	// frameDone is set in single-frame mode after the frame is read.
+	frameDone bool
+
+	// outFull is set if the last decompression filled the output buffer,
+	// so zr.ds may contain more data to decompress.
+	outFull bool
+
+	skippableFrameHandler func(magicVariant uint32, payload []byte) error
+	skippableBuf          []byte
+
+	// atFrameStart is set to true when the next input byte starts a new frame.
+	atFrameStart bool
 
 	inBuf  *C.ZSTD_inBuffer
 	outBuf *C.ZSTD_outBuffer
 
 	inBufGo  cMemPtr
 	outBufGo cMemPtr
+
+	// err is the error, which is returned from all the subsequent calls
+	// until zr is reset.
+	err error
 }
 
 // NewReader returns new zstd reader reading compressed data from r.
 //
 // Call Release when the Reader is no longer needed.
 func NewReader(r io.Reader) *Reader {
-	return NewReaderDict(r, nil)
+	return NewReaderParams(r, nil)
 }
 
 // NewReaderDict returns new zstd reader reading compressed data from r
@@ -70,8 +114,81 @@ func NewReader(r io.Reader) *Reader {
 //
 // Call Release when the Reader is no longer needed.
 func NewReaderDict(r io.Reader, dd *DDict) *Reader {
+	params := &ReaderParams{
+		Dict: dd,
+	}
+	return NewReaderParams(r, params)
+}
+
+// A ReaderParams allows users to specify decompression parameters by calling
+// NewReaderParams.
+//
+// Calling NewReaderParams with a nil ReaderParams is equivalent to calling
+// NewReader.
+type ReaderParams struct {
+	// MaxWindowLog is the maximum windowLog accepted by the decompressor.
+	// Frames requiring bigger window are rejected with ErrWindowTooLarge.
+	// Must be clamped between WindowLogMin and WindowLogMax.
+	// Special value 0 means 'use default limit', which equals to 27.
+	//
+	// Set it to WindowLog passed to WriterParams if the data was compressed
+	// with WindowLog greater than 27.
+	MaxWindowLog int
+
+	// MaxDecompressedSize is the maximum number of decompressed bytes,
+	// which may be read from the Reader.
+	// Special value 0 means 'no limit'.
+	//
+	// ErrDecompressedSizeTooLarge is returned when the limit is exceeded.
+	MaxDecompressedSize int64
+
+	// Dict is optional dictionary used for decompression.
+	Dict *DDict
+
+	// SkippableFrameHandler is optional callback, which is called for every
+	// skippable frame in the stream with the frame magic variant and payload.
+	// Skippable frames are silently skipped if the callback isn't set.
+	//
+	// The payload is valid only during the call, so it must be copied
+	// if it is used after the call.
+	// The error returned from the callback is returned from Read or WriteTo.
+	SkippableFrameHandler func(magicVariant uint32, payload []byte) error
+
+	// SkipChecksum disables verification of content checksums stored
+	// in frames. By default the checksums are verified and ErrChecksumWrong
+	// is returned on mismatch.
+	SkipChecksum bool
+
+	// SingleFrame makes the Reader return io.EOF at the end of the first
+	// zstd frame. Skippable frames before it are skipped.
+	//
+	// The Reader doesn't read data past the end of the frame from
+	// the underlying reader in this mode, so the data after the frame
+	// may be read from the underlying reader after io.EOF is returned.
+	SingleFrame bool
+
+	// Context is optional context for canceling the decompression.
+	//
+	// The context is checked between decompressed chunks. Read and WriteTo
+	// return Context.Err() after the context is done.
+	// Reset drops the context and makes the Reader usable again.
+	// ResetReaderParams makes the Reader usable again if the new context
+	// isn't done.
+	Context context.Context
+}
+
+// NewReaderParams returns new zstd reader reading compressed data from r
+// using the given set of parameters.
+//
+// Invalid params result in error returned from the first Read or WriteTo call.
+//
+// Call Release when the Reader is no longer needed.
+func NewReaderParams(r io.Reader, params *ReaderParams) *Reader {
+	if params == nil {
+		params = &ReaderParams{}
+	}
+
 	ds := C.ZSTD_createDStream()
-	initDStream(ds, dd)
 
 	inBuf := (*C.ZSTD_inBuffer)(C.calloc(1, C.sizeof_ZSTD_inBuffer))
 	inBuf.src = C.calloc(1, dstreamInBufSize)
@@ -84,42 +201,109 @@ func NewReaderDict(r io.Reader, dd *DDict) *Reader {
 	outBuf.pos = 0
 
 	zr := &Reader{
-		r:      r,
-		ds:     ds,
-		dd:     dd,
+		r:            r,
+		ds:           ds,
+		dd:           params.Dict,
+		wlogMax:      params.MaxWindowLog,
+		maxSize:      params.MaxDecompressedSize,
+		skipChecksum: params.SkipChecksum,
+		singleFrame:  params.SingleFrame,
+		ctx:          params.Context,
+		srcSizeHint:  C.ZSTD_SKIPPABLEHEADERSIZE,
+
+		skippableFrameHandler: params.SkippableFrameHandler,
+		atFrameStart:          true,
+
 		inBuf:  inBuf,
 		outBuf: outBuf,
 	}
 
 	zr.inBufGo = cMemPtr(zr.inBuf.src)
 	zr.outBufGo = cMemPtr(zr.outBuf.dst)
+	zr.err = initDStream(ds, *params)
 
 	runtime.SetFinalizer(zr, freeDStream)
 	return zr
 }
 
 // Reset resets zr to read from r using the given dictionary dd.
+// Use ResetReaderParams if you wish to change other parameters that were
+// set via ReaderParams.
+//
+// Reset drops ReaderParams.Context.
 func (zr *Reader) Reset(r io.Reader, dd *DDict) {
+	params := ReaderParams{
+		MaxWindowLog:          zr.wlogMax,
+		MaxDecompressedSize:   zr.maxSize,
+		Dict:                  dd,
+		SkippableFrameHandler: zr.skippableFrameHandler,
+		SkipChecksum:          zr.skipChecksum,
+		SingleFrame:           zr.singleFrame,
+	}
+	zr.ResetReaderParams(r, &params)
+}
+
+// ResetReaderParams resets zr to read from r using the given set of parameters.
+func (zr *Reader) ResetReaderParams(r io.Reader, params *ReaderParams) {
 	zr.inBuf.size = 0
 	zr.inBuf.pos = 0
 	zr.outBuf.size = 0
 	zr.outBuf.pos = 0
-
-	zr.dd = dd
-	initDStream(zr.ds, zr.dd)
+	zr.outFull = false
+
+	zr.dd = params.Dict
+	zr.wlogMax = params.MaxWindowLog
+	zr.maxSize = params.MaxDecompressedSize
+	zr.skipChecksum = params.SkipChecksum
+	zr.singleFrame = params.SingleFrame
+	zr.ctx = params.Context
+	zr.decompressed = 0
+	zr.bytesRead = 0
+	zr.srcSizeHint = C.ZSTD_SKIPPABLEHEADERSIZE
+	zr.frameDone = false
+	zr.skippableFrameHandler = params.SkippableFrameHandler
+	zr.atFrameStart = true
+	zr.err = initDStream(zr.ds, *params)
 
 	zr.r = r
 }
 
-func initDStream(ds *C.ZSTD_DStream, dd *DDict) {
+func initDStream(ds *C.ZSTD_DStream, params ReaderParams) error {
 	var ddict *C.ZSTD_DDict
-	if dd != nil {
-		ddict = dd.p
+	if params.Dict != nil {
+		ddict = params.Dict.p
 	}
 	result := C.ZSTD_initDStream_usingDDict_wrapper(
 		C.uintptr_t(uintptr(unsafe.Pointer(ds))),
 		C.uintptr_t(uintptr(unsafe.Pointer(ddict))))
-	ensureNoError("ZSTD_initDStream_usingDDict", result)
+	if err := newError(result); err != nil {
+		return fmt.Errorf("cannot set dictionary: %w", err)
+	}
+
+	result = C.ZSTD_DCtx_setParameter_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(ds))),
+		C.ZSTD_dParameter(C.ZSTD_d_windowLogMax),
+		C.int(params.MaxWindowLog))
+	if err := newError(result); err != nil {
+		return fmt.Errorf("cannot set MaxWindowLog %d: %w", params.MaxWindowLog, err)
+	}
+
+	ignoreChecksum := C.ZSTD_d_validateChecksum
+	if params.SkipChecksum {
+		ignoreChecksum = C.ZSTD_d_ignoreChecksum
+	}
+	result = C.ZSTD_DCtx_setParameter_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(ds))),
+		C.ZSTD_dParameter(C.ZSTD_d_forceIgnoreChecksum),
+		C.int(ignoreChecksum))
+	if err := newError(result); err != nil {
+		return fmt.Errorf("cannot set checksum verification mode: %w", err)
+	}
+
+	if params.MaxDecompressedSize < 0 {
+		return fmt.Errorf("MaxDecompressedSize cannot be negative; got %d", params.MaxDecompressedSize)
+	}
+	return nil
 }
 
 func freeDStream(v interface{}) {
@@ -149,12 +333,20 @@ func (zr *Reader) Release() {
 
 	zr.r = nil
 	zr.dd = nil
+	zr.skippableFrameHandler = nil
+	zr.skippableBuf = nil
+	zr.ctx = nil
+	zr.err = nil
 }
 
 // WriteTo writes all the data from zr to w.
 //
 // It returns the number of bytes written to w.
 func (zr *Reader) WriteTo(w io.Writer) (int64, error) {
+	if zr.err != nil {
+		return 0, zr.err
+	}
+
 	nn := int64(0)
 	for {
 		if zr.outBuf.pos == zr.outBuf.size {
@@ -176,11 +368,19 @@ func (zr *Reader) WriteTo(w io.Writer) (int64, error) {
 
 // Read reads up to len(p) bytes from zr to p.
 func (zr *Reader) Read(p []byte) (int, error) {
+	if zr.err != nil {
+		return 0, zr.err
+	}
 	if len(p) == 0 {
 		return 0, nil
 	}
 
 	if zr.outBuf.pos == zr.outBuf.size {
+		if len(p) >= int(dstreamOutBufSize) {
+			// Fast path - decompress directly into p without copying
+			// the data via outBuf.
+			return zr.decompressStream(p)
+		}
 		if err := zr.fillOutBuf(); err != nil {
 			return 0, err
 		}
@@ -191,36 +391,117 @@ func (zr *Reader) Read(p []byte) (int, error) {
 	return n, nil
 }
 
+// ConsumedBytes returns the number of compressed bytes consumed by zr
+// since the last reset.
+//
+// It may be smaller than the number of bytes read from the underlying
+// reader, since zr reads data in chunks.
+func (zr *Reader) ConsumedBytes() int64 {
+	return zr.bytesRead - int64(zr.inBuf.size-zr.inBuf.pos)
+}
+
 func (zr *Reader) fillOutBuf() error {
-	if zr.inBuf.pos == zr.inBuf.size && zr.outBuf.size < dstreamOutBufSize {
-		// inBuf is empty and the previously decompressed data size
-		// is smaller than the maximum possible zr.outBuf.size.
+	_, err := zr.decompressStream(nil)
+	return err
+}
+
+// decompressStream decompresses the next chunk of data into p
+// and returns the size of the decompressed chunk.
+//
+// The data is decompressed into outBuf if p is nil.
+func (zr *Reader) decompressStream(p []byte) (int, error) {
+	if zr.frameDone {
+		return 0, io.EOF
+	}
+	if zr.inBuf.pos == zr.inBuf.size && !zr.outFull {
+		// inBuf is empty and the previously decompressed data
+		// didn't fill the output buffer.
 		// This means that the internal buffer in zr.ds doesn't contain
 		// more data to decompress, so read new data into inBuf.
 		if err := zr.fillInBuf(); err != nil {
-			return err
+			return 0, zr.checkEOF(err)
 		}
 	}
 
 tryDecompressAgain:
-	// Try decompressing inBuf into outBuf.
-	zr.outBuf.size = dstreamOutBufSize
-	zr.outBuf.pos = 0
+	if zr.ctx != nil {
+		if err := zr.ctx.Err(); err != nil {
+			// The error is sticky, since the frame may be left unfinished.
+			zr.err = err
+			return 0, err
+		}
+	}
+	if zr.atFrameStart && (zr.skippableFrameHandler != nil || zr.singleFrame) {
+		if err := zr.readSkippableFrames(); err != nil {
+			return 0, err
+		}
+	}
+
+	// Try decompressing inBuf into the output buffer.
 	prevInBufPos := zr.inBuf.pos
-	result := C.ZSTD_decompressStream_wrapper(
-		C.uintptr_t(uintptr(unsafe.Pointer(zr.ds))),
-		C.uintptr_t(uintptr(unsafe.Pointer(zr.outBuf))),
-		C.uintptr_t(uintptr(unsafe.Pointer(zr.inBuf))))
-	zr.outBuf.size = zr.outBuf.pos
-	zr.outBuf.pos = 0
+	var n C.size_t
+	var result C.size_t
+	if p == nil {
+		zr.outBuf.size = dstreamOutBufSize
+		zr.outBuf.pos = 0
+		result = C.ZSTD_decompressStream_wrapper(
+			C.uintptr_t(uintptr(unsafe.Pointer(zr.ds))),
+			C.uintptr_t(uintptr(unsafe.Pointer(zr.outBuf))),
+			C.uintptr_t(uintptr(unsafe.Pointer(zr.inBuf))))
+		n = zr.outBuf.pos
+		zr.outBuf.size = n
+		zr.outBuf.pos = 0
+		zr.outFull = n == dstreamOutBufSize
+	} else {
+		// outBuf is empty, so its pos may hold the position in p.
+		zr.outBuf.size = 0
+		zr.outBuf.pos = 0
+		result = C.ZSTD_decompressStream_simpleArgs_wrapper(
+			C.uintptr_t(uintptr(unsafe.Pointer(zr.ds))),
+			C.uintptr_t(uintptr(unsafe.Pointer(&p[0]))),
+			C.size_t(len(p)),
+			C.uintptr_t(uintptr(unsafe.Pointer(&zr.outBuf.pos))),
+			C.uintptr_t(uintptr(unsafe.Pointer(zr.inBuf))))
+		// Prevent from GC'ing of p during CGO call above.
+		runtime.KeepAlive(p)
+		n = zr.outBuf.pos
+		zr.outBuf.pos = 0
+		zr.outFull = int(n) == len(p)
+	}
 
-	if C.ZSTD_getErrorCode(result) != 0 {
-		return fmt.Errorf("cannot decompress data: %s", errStr(result))
+	if err := newError(result); err != nil {
+		return 0, fmt.Errorf("cannot decompress data: %w", err)
+	}
+	if result == 0 {
+		// zstd returns 0 after the frame is fully decompressed and flushed.
+		zr.atFrameStart = true
+		// Every valid frame is at least ZSTD_SKIPPABLEHEADERSIZE bytes long.
+		zr.srcSizeHint = C.ZSTD_SKIPPABLEHEADERSIZE
+		if zr.singleFrame {
+			// Skippable frames have been already skipped
+			// by readSkippableFrames, so this is the end
+			// of the zstd frame.
+			zr.frameDone = true
+		}
+	} else if zr.inBuf.pos != prevInBufPos || n > 0 {
+		// The frame is in progress.
+		zr.atFrameStart = false
+		// zstd never asks for the data past the end of the frame.
+		zr.srcSizeHint = result
 	}
 
-	if zr.outBuf.size > 0 {
-		// Something has been decompressed to outBuf. Return it.
-		return nil
+	if n > 0 {
+		// Something has been decompressed. Return it.
+		zr.decompressed += int64(n)
+		if zr.maxSize > 0 && zr.decompressed > zr.maxSize {
+			zr.outBuf.size = 0
+			zr.err = fmt.Errorf("decompressed data exceeds the limit %d: %w", zr.maxSize, ErrDecompressedSizeTooLarge)
+			return 0, zr.err
+		}
+		return int(n), nil
+	}
+	if zr.frameDone {
+		return 0, io.EOF
 	}
 
 	// Nothing has been decompressed from inBuf.
@@ -235,21 +516,127 @@ tryDecompressAgain:
 	// decompressed into nothing and inBuf became empty.
 	// Read more data into inBuf and try decompressing again.
 	if err := zr.fillInBuf(); err != nil {
-		return err
+		return 0, zr.checkEOF(err)
 	}
 	goto tryDecompressAgain
 }
 
+// checkEOF converts io.EOF in the middle of a frame to io.ErrUnexpectedEOF.
+func (zr *Reader) checkEOF(err error) error {
+	if err != io.EOF || (zr.atFrameStart && zr.inBuf.pos == zr.inBuf.size) {
+		return err
+	}
+	zr.err = fmt.Errorf("compressed data ends in the middle of a frame: %w", io.ErrUnexpectedEOF)
+	return zr.err
+}
+
+// readSkippableFrames passes skippable frames at the start of inBuf
+// to zr.skippableFrameHandler.
+//
+// Skippable frames are dropped if zr.skippableFrameHandler isn't set.
+func (zr *Reader) readSkippableFrames() error {
+	for {
+		zr.srcSizeHint = C.ZSTD_SKIPPABLEHEADERSIZE
+		// Every valid frame is at least ZSTD_SKIPPABLEHEADERSIZE bytes long.
+		for zr.inBuf.size-zr.inBuf.pos < C.ZSTD_SKIPPABLEHEADERSIZE {
+			if err := zr.fillInBuf(); err != nil {
+				if err == io.EOF && zr.inBuf.pos < zr.inBuf.size {
+					// Let zstd deal with the incomplete frame.
+					zr.atFrameStart = false
+					return nil
+				}
+				return err
+			}
+		}
+
+		header := zr.inBufGo[zr.inBuf.pos : zr.inBuf.pos+C.ZSTD_SKIPPABLEHEADERSIZE]
+		magic := binary.LittleEndian.Uint32(header)
+		if magic&C.ZSTD_MAGIC_SKIPPABLE_MASK != C.ZSTD_MAGIC_SKIPPABLE_START {
+			zr.atFrameStart = false
+			return nil
+		}
+		payloadSize := uint64(binary.LittleEndian.Uint32(header[4:]))
+		zr.inBuf.pos += C.ZSTD_SKIPPABLEHEADERSIZE
+
+		if zr.skippableFrameHandler == nil {
+			if err := zr.discardInput(payloadSize); err != nil {
+				return fmt.Errorf("cannot read skippable frame payload: %w", err)
+			}
+			continue
+		}
+
+		payload := zr.skippableBuf[:0]
+		for uint64(len(payload)) < payloadSize {
+			if zr.inBuf.pos == zr.inBuf.size {
+				zr.srcSizeHint = C.size_t(payloadSize - uint64(len(payload)))
+				if err := zr.fillInBuf(); err != nil {
+					if err == io.EOF {
+						err = io.ErrUnexpectedEOF
+					}
+					return fmt.Errorf("cannot read skippable frame payload: %w", err)
+				}
+			}
+			n := zr.inBuf.size - zr.inBuf.pos
+			if remaining := payloadSize - uint64(len(payload)); uint64(n) > remaining {
+				n = C.size_t(remaining)
+			}
+			payload = append(payload, zr.inBufGo[zr.inBuf.pos:zr.inBuf.pos+n]...)
+			zr.inBuf.pos += n
+		}
+		zr.skippableBuf = payload
+
+		if err := zr.skippableFrameHandler(magic-C.ZSTD_MAGIC_SKIPPABLE_START, payload); err != nil {
+			zr.err = fmt.Errorf("error in skippable frame handler: %w", err)
+			return zr.err
+		}
+	}
+}
+
+// discardInput drops n bytes from the input.
+func (zr *Reader) discardInput(n uint64) error {
+	for n > 0 {
+		if zr.inBuf.pos == zr.inBuf.size {
+			zr.srcSizeHint = C.size_t(n)
+			if err := zr.fillInBuf(); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+		}
+		m := zr.inBuf.size - zr.inBuf.pos
+		if uint64(m) > n {
+			m = C.size_t(n)
+		}
+		zr.inBuf.pos += m
+		n -= uint64(m)
+	}
+	return nil
+}
+
 func (zr *Reader) fillInBuf() error {
 	// Copy the remaining data to the start of inBuf.
 	copy(zr.inBufGo[:dstreamInBufSize], zr.inBufGo[zr.inBuf.pos:zr.inBuf.size])
 	zr.inBuf.size -= zr.inBuf.pos
 	zr.inBuf.pos = 0
 
+	inBufEnd := dstreamInBufSize
+	if zr.singleFrame {
+		// Do not read past the end of the frame.
+		n := C.size_t(1)
+		if zr.srcSizeHint > zr.inBuf.size {
+			n = zr.srcSizeHint - zr.inBuf.size
+		}
+		if zr.inBuf.size+n < inBufEnd {
+			inBufEnd = zr.inBuf.size + n
+		}
+	}
+
 readAgain:
 	// Read more data into inBuf.
-	n, err := zr.r.Read(zr.inBufGo[zr.inBuf.size:dstreamInBufSize])
+	n, err := zr.r.Read(zr.inBufGo[zr.inBuf.size:inBufEnd])
 	zr.inBuf.size += C.size_t(n)
+	zr.bytesRead += int64(n)
 	if err == nil {
 		if n == 0 {
 			// Nothing has been read. Try reading data again.
@@ -265,5 +652,5 @@ readAgain:
 		// Do not wrap io.EOF, so the caller may notify the end of stream.
 		return err
 	}
-	return fmt.Errorf("cannot read data from the underlying reader: %s", err)
+	return fmt.Errorf("cannot read data from the underlying reader: %w", err)
 }
@@ -2,12 +2,15 @@ package gozstd
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -317,3 +320,550 @@ func testReaderExt(zr *Reader, s string) error {
 	}
 	return nil
 }
+
+func TestReaderParamsMaxWindowLog(t *testing.T) {
+	const wlog = 28
+	src := []byte(newTestString(512, 3))
+
+	var bb bytes.Buffer
+	zw := NewWriterParams(&bb, &WriterParams{WindowLog: wlog})
+	if _, err := zw.Write(src); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close zw: %s", err)
+	}
+	zw.Release()
+	cd := bb.Bytes()
+
+	// The default windowLogMax is too small for the data.
+	zr := NewReader(bytes.NewReader(cd))
+	defer zr.Release()
+	if _, err := ioutil.ReadAll(zr); !errors.Is(err, ErrWindowTooLarge) {
+		t.Fatalf("unexpected error with default MaxWindowLog; got %v; want %v", err, ErrWindowTooLarge)
+	}
+
+	params := &ReaderParams{
+		MaxWindowLog: wlog,
+	}
+	zr.ResetReaderParams(bytes.NewReader(cd), params)
+	plainData, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("cannot read data with MaxWindowLog=%d: %s", wlog, err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected data read; got\n%X; want\n%X", plainData, src)
+	}
+
+	// Reset must preserve MaxWindowLog.
+	zr.Reset(bytes.NewReader(cd), nil)
+	plainData, err = ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("cannot read data after Reset: %s", err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected data read after Reset; got\n%X; want\n%X", plainData, src)
+	}
+
+	var bbOut bytes.Buffer
+	if err := StreamDecompressParams(&bbOut, bytes.NewReader(cd), params); err != nil {
+		t.Fatalf("cannot stream decompress data with MaxWindowLog=%d: %s", wlog, err)
+	}
+	if !bytes.Equal(bbOut.Bytes(), src) {
+		t.Fatalf("unexpected data stream decompressed; got\n%X; want\n%X", bbOut.Bytes(), src)
+	}
+	if err := StreamDecompress(&bbOut, bytes.NewReader(cd)); !errors.Is(err, ErrWindowTooLarge) {
+		t.Fatalf("unexpected error in StreamDecompress; got %v; want %v", err, ErrWindowTooLarge)
+	}
+}
+
+func TestReaderParamsMaxDecompressedSize(t *testing.T) {
+	src := []byte(newTestString(4*int(dstreamOutBufSize), 3))
+	cd := Compress(nil, src)
+
+	params := &ReaderParams{
+		MaxDecompressedSize: int64(len(src)),
+	}
+	zr := NewReaderParams(bytes.NewReader(cd), params)
+	defer zr.Release()
+	plainData, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("cannot read data: %s", err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected data read; got\n%X; want\n%X", plainData, src)
+	}
+
+	params.MaxDecompressedSize = int64(len(src)) - 1
+	zr.ResetReaderParams(bytes.NewReader(cd), params)
+	if _, err := ioutil.ReadAll(zr); !errors.Is(err, ErrDecompressedSizeTooLarge) {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrDecompressedSizeTooLarge)
+	}
+	if _, err := zr.Read(make([]byte, 10)); !errors.Is(err, ErrDecompressedSizeTooLarge) {
+		t.Fatalf("the error must be sticky; got %v; want %v", err, ErrDecompressedSizeTooLarge)
+	}
+	if err := StreamDecompressParams(ioutil.Discard, bytes.NewReader(cd), params); !errors.Is(err, ErrDecompressedSizeTooLarge) {
+		t.Fatalf("unexpected error in StreamDecompressParams; got %v; want %v", err, ErrDecompressedSizeTooLarge)
+	}
+}
+
+func TestReaderParamsSkipChecksum(t *testing.T) {
+	src := []byte(newTestString(64*1024, 3))
+
+	var bb bytes.Buffer
+	zw := NewWriterParams(&bb, &WriterParams{Checksum: true})
+	if _, err := zw.Write(src); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close zw: %s", err)
+	}
+	zw.Release()
+
+	// Corrupt the checksum at the end of the frame.
+	cd := bb.Bytes()
+	cd[len(cd)-1]++
+
+	zr := NewReader(bytes.NewReader(cd))
+	defer zr.Release()
+	if _, err := ioutil.ReadAll(zr); !errors.Is(err, ErrChecksumWrong) {
+		t.Fatalf("unexpected error for corrupted checksum; got %v; want %v", err, ErrChecksumWrong)
+	}
+
+	zr.ResetReaderParams(bytes.NewReader(cd), &ReaderParams{SkipChecksum: true})
+	plainData, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("cannot read data with SkipChecksum: %s", err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected data read with SkipChecksum")
+	}
+
+	// Reset must preserve SkipChecksum.
+	zr.Reset(bytes.NewReader(cd), nil)
+	if _, err := ioutil.ReadAll(zr); err != nil {
+		t.Fatalf("cannot read data after Reset: %s", err)
+	}
+}
+
+func TestReaderParamsInvalid(t *testing.T) {
+	zr := NewReaderParams(bytes.NewReader(Compress(nil, []byte("foobar"))), &ReaderParams{MaxWindowLog: 100})
+	defer zr.Release()
+	if _, err := ioutil.ReadAll(zr); !errors.Is(err, ErrParameterOutOfBound) {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrParameterOutOfBound)
+	}
+
+	// ResetReaderParams must clear the error.
+	zr.ResetReaderParams(bytes.NewReader(Compress(nil, []byte("foobar"))), &ReaderParams{})
+	plainData, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("unexpected error after ResetReaderParams: %s", err)
+	}
+	if string(plainData) != "foobar" {
+		t.Fatalf("unexpected data read; got %q; want %q", plainData, "foobar")
+	}
+}
+
+func TestReaderSkippableFrameHandler(t *testing.T) {
+	var cd []byte
+	var err error
+	cd, err = AppendSkippableFrame(cd, 1, []byte("header"))
+	if err != nil {
+		t.Fatalf("cannot append skippable frame: %s", err)
+	}
+	src := newTestString(300*1024, 10)
+	cd = Compress(cd, []byte(src))
+	cd, err = AppendSkippableFrame(cd, 2, nil)
+	if err != nil {
+		t.Fatalf("cannot append skippable frame: %s", err)
+	}
+	bigPayload := []byte(newTestString(500*1024, 3))
+	cd, err = AppendSkippableFrame(cd, 3, bigPayload)
+	if err != nil {
+		t.Fatalf("cannot append skippable frame: %s", err)
+	}
+	cd = Compress(cd, []byte(src))
+	cd, err = AppendSkippableFrame(cd, 4, []byte("footer"))
+	if err != nil {
+		t.Fatalf("cannot append skippable frame: %s", err)
+	}
+
+	type frame struct {
+		magicVariant uint32
+		payload      string
+	}
+	var frames []frame
+	zr := NewReaderParams(bytes.NewReader(cd), &ReaderParams{
+		SkippableFrameHandler: func(magicVariant uint32, payload []byte) error {
+			frames = append(frames, frame{
+				magicVariant: magicVariant,
+				payload:      string(payload),
+			})
+			return nil
+		},
+	})
+	defer zr.Release()
+
+	plainData, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("cannot read data: %s", err)
+	}
+	if string(plainData) != src+src {
+		t.Fatalf("unexpected decompressed data")
+	}
+	expectedFrames := []frame{
+		{1, "header"},
+		{2, ""},
+		{3, string(bigPayload)},
+		{4, "footer"},
+	}
+	if len(frames) != len(expectedFrames) {
+		t.Fatalf("unexpected number of skippable frames; got %d; want %d", len(frames), len(expectedFrames))
+	}
+	for i, f := range frames {
+		if f != expectedFrames[i] {
+			t.Fatalf("unexpected skippable frame #%d; got magicVariant=%d, len(payload)=%d; want magicVariant=%d, len(payload)=%d",
+				i, f.magicVariant, len(f.payload), expectedFrames[i].magicVariant, len(expectedFrames[i].payload))
+		}
+	}
+
+	// Verify the handler is preserved on Reset and the frames are skipped without it.
+	frames = frames[:0]
+	zr.Reset(bytes.NewReader(cd), nil)
+	if _, err := ioutil.ReadAll(zr); err != nil {
+		t.Fatalf("cannot read data after reset: %s", err)
+	}
+	if len(frames) != len(expectedFrames) {
+		t.Fatalf("unexpected number of skippable frames after reset; got %d; want %d", len(frames), len(expectedFrames))
+	}
+	frames = frames[:0]
+	zr.ResetReaderParams(bytes.NewReader(cd), &ReaderParams{})
+	plainData, err = ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("cannot read data without handler: %s", err)
+	}
+	if string(plainData) != src+src {
+		t.Fatalf("unexpected decompressed data without handler")
+	}
+	if len(frames) != 0 {
+		t.Fatalf("unexpected skippable frames passed to the removed handler: %d", len(frames))
+	}
+}
+
+func TestReaderSkippableFrameHandlerError(t *testing.T) {
+	cd := Compress(nil, []byte("foobar"))
+	cd, err := AppendSkippableFrame(cd, 0, []byte("metadata"))
+	if err != nil {
+		t.Fatalf("cannot append skippable frame: %s", err)
+	}
+
+	errHandler := errors.New("handler error")
+	zr := NewReaderParams(bytes.NewReader(cd), &ReaderParams{
+		SkippableFrameHandler: func(magicVariant uint32, payload []byte) error {
+			return errHandler
+		},
+	})
+	defer zr.Release()
+	if _, err := ioutil.ReadAll(zr); !errors.Is(err, errHandler) {
+		t.Fatalf("unexpected error; got %v; want %v", err, errHandler)
+	}
+
+	// Truncated skippable frame.
+	zr.ResetReaderParams(bytes.NewReader(cd[:len(cd)-1]), &ReaderParams{
+		SkippableFrameHandler: func(magicVariant uint32, payload []byte) error {
+			return nil
+		},
+	})
+	if _, err := ioutil.ReadAll(zr); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("unexpected error for truncated skippable frame; got %v; want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestReaderSingleFrame(t *testing.T) {
+	data1 := newTestString(1024*1024, 3)
+	data2 := newTestString(1000, 3)
+	frame1 := mustCompressWriter(t, data1)
+	frame2 := mustCompressWriter(t, data2)
+	emptyFrame := mustCompressWriter(t, "")
+	skippableFrame, err := AppendSkippableFrame(nil, 3, []byte("skippable payload"))
+	if err != nil {
+		t.Fatalf("cannot create skippable frame: %s", err)
+	}
+	const trailer = "the data after the frames"
+
+	var src []byte
+	src = append(src, frame1...)
+	src = append(src, skippableFrame...)
+	src = append(src, frame2...)
+	src = append(src, emptyFrame...)
+	src = append(src, trailer...)
+
+	f := func(r io.Reader, params *ReaderParams) {
+		t.Helper()
+		rest := func() string {
+			t.Helper()
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("cannot read the rest of data: %s", err)
+			}
+			return string(b)
+		}
+		testReaderSingleFrame(t, NewReaderParams(r, params), data1, len(frame1))
+		testReaderSingleFrame(t, NewReaderParams(r, params), data2, len(skippableFrame)+len(frame2))
+		testReaderSingleFrame(t, NewReaderParams(r, params), "", len(emptyFrame))
+		if s := rest(); s != trailer {
+			t.Fatalf("unexpected data after the frames; got %q; want %q", s, trailer)
+		}
+	}
+
+	params := &ReaderParams{SingleFrame: true}
+	f(bytes.NewReader(src), params)
+	f(iotest.OneByteReader(bytes.NewReader(src)), params)
+	f(iotest.HalfReader(bytes.NewReader(src)), params)
+
+	var payloads []string
+	params = &ReaderParams{
+		SingleFrame: true,
+		SkippableFrameHandler: func(magicVariant uint32, payload []byte) error {
+			payloads = append(payloads, string(payload))
+			return nil
+		},
+	}
+	f(bytes.NewReader(src), params)
+	if len(payloads) != 1 || payloads[0] != "skippable payload" {
+		t.Fatalf("unexpected skippable frames passed to the handler: %q", payloads)
+	}
+
+	// Reset must preserve SingleFrame.
+	br := bytes.NewReader(src)
+	zr := NewReaderParams(br, &ReaderParams{SingleFrame: true})
+	defer zr.Release()
+	if _, err := ioutil.ReadAll(zr); err != nil {
+		t.Fatalf("cannot read the first frame: %s", err)
+	}
+	zr.Reset(br, nil)
+	testReaderSingleFrame(t, zr, data2, len(skippableFrame)+len(frame2))
+}
+
+func testReaderSingleFrame(t *testing.T, zr *Reader, dataExpected string, consumedExpected int) {
+	t.Helper()
+	defer zr.Release()
+
+	var bb bytes.Buffer
+	if _, err := zr.WriteTo(&bb); err != nil {
+		t.Fatalf("cannot read the frame: %s", err)
+	}
+	if bb.String() != dataExpected {
+		t.Fatalf("unexpected data read; got %d bytes; want %d bytes", bb.Len(), len(dataExpected))
+	}
+	if n := zr.ConsumedBytes(); n != int64(consumedExpected) {
+		t.Fatalf("unexpected number of consumed bytes; got %d; want %d", n, consumedExpected)
+	}
+
+	// The subsequent reads must return io.EOF.
+	if n, err := zr.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Fatalf("unexpected result after the frame end; got %d, %v; want 0, %v", n, err, io.EOF)
+	}
+}
+
+func TestReaderConsumedBytes(t *testing.T) {
+	data := newTestString(300*1024, 3)
+	cd := mustCompressWriter(t, data)
+	cd = append(cd, cd...)
+
+	zr := NewReader(bytes.NewReader(cd))
+	defer zr.Release()
+	if n := zr.ConsumedBytes(); n != 0 {
+		t.Fatalf("unexpected number of consumed bytes before reading; got %d; want 0", n)
+	}
+	plainData, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("cannot read data: %s", err)
+	}
+	if string(plainData) != data+data {
+		t.Fatalf("unexpected data read")
+	}
+	if n := zr.ConsumedBytes(); n != int64(len(cd)) {
+		t.Fatalf("unexpected number of consumed bytes; got %d; want %d", n, len(cd))
+	}
+
+	// Reset must reset the number of consumed bytes.
+	zr.Reset(bytes.NewReader(cd), nil)
+	if n := zr.ConsumedBytes(); n != 0 {
+		t.Fatalf("unexpected number of consumed bytes after Reset; got %d; want 0", n)
+	}
+}
+
+func mustCompressWriter(t *testing.T, data string) []byte {
+	t.Helper()
+	var bb bytes.Buffer
+	zw := NewWriter(&bb)
+	defer zw.Release()
+	if _, err := zw.Write([]byte(data)); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close zw: %s", err)
+	}
+	return bb.Bytes()
+}
+
+func TestReaderTruncated(t *testing.T) {
+	frame := mustCompressWriter(t, newTestString(300*1024, 3))
+	skippableFrame, err := AppendSkippableFrame(nil, 0, []byte("foobar"))
+	if err != nil {
+		t.Fatalf("cannot create skippable frame: %s", err)
+	}
+	var src []byte
+	src = append(src, frame...)
+	src = append(src, skippableFrame...)
+	src = append(src, frame...)
+
+	boundaries := map[int]bool{
+		0:                                  true,
+		len(frame):                         true,
+		len(frame) + len(skippableFrame):   true,
+		2*len(frame) + len(skippableFrame): true,
+	}
+	for _, n := range []int{0, 1, 4, 8, 100, len(frame) / 2, len(frame) - 1, len(frame), len(frame) + 1,
+		len(frame) + len(skippableFrame) - 1, len(frame) + len(skippableFrame), len(src) - 1, len(src)} {
+		zr := NewReader(bytes.NewReader(src[:n]))
+		_, err := ioutil.ReadAll(zr)
+		if boundaries[n] {
+			if err != nil {
+				t.Fatalf("unexpected error for data ending at frame boundary %d: %s", n, err)
+			}
+		} else {
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("unexpected error for data truncated at %d; got %v; want %v", n, err, io.ErrUnexpectedEOF)
+			}
+			// The error must be sticky.
+			if _, err := zr.Read(make([]byte, 1)); !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("unexpected error on the next read for data truncated at %d; got %v; want %v", n, err, io.ErrUnexpectedEOF)
+			}
+
+			var bb bytes.Buffer
+			if err := StreamDecompress(&bb, bytes.NewReader(src[:n])); !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("unexpected error in StreamDecompress for data truncated at %d; got %v; want %v", n, err, io.ErrUnexpectedEOF)
+			}
+		}
+		zr.Release()
+	}
+
+	// Decompress must detect truncated frames without content size.
+	if _, err := Decompress(nil, frame[:len(frame)-1]); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("unexpected error in Decompress; got %v; want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestReaderLargeBuffers(t *testing.T) {
+	data := newTestString(3*1024*1024, 3)
+	cd := mustCompressWriter(t, data)
+	src := append(append([]byte{}, cd...), cd...)
+
+	for _, bufSize := range []int{int(dstreamOutBufSize), int(dstreamOutBufSize) + 1, 1024 * 1024, 10 * 1024 * 1024} {
+		zr := NewReader(bytes.NewReader(src))
+		var plainData []byte
+		buf := make([]byte, bufSize)
+		for {
+			n, err := zr.Read(buf)
+			plainData = append(plainData, buf[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("cannot read data with buffer of size %d: %s", bufSize, err)
+			}
+		}
+		if string(plainData) != data+data {
+			t.Fatalf("unexpected data read with buffer of size %d", bufSize)
+		}
+		zr.Release()
+
+		// The decompressed size must be limited for large buffers too.
+		zr = NewReaderParams(bytes.NewReader(src), &ReaderParams{MaxDecompressedSize: int64(len(data))})
+		_, err := io.ReadFull(zr, make([]byte, 2*len(data)))
+		if !errors.Is(err, ErrDecompressedSizeTooLarge) {
+			t.Fatalf("unexpected error with buffer of size %d; got %v; want %v", bufSize, err, ErrDecompressedSizeTooLarge)
+		}
+		zr.Release()
+
+		// Truncated data must be detected for large buffers too.
+		zr = NewReader(bytes.NewReader(cd[:len(cd)-1]))
+		_, err = io.ReadFull(zr, make([]byte, 2*len(data)))
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("unexpected error for truncated data with buffer of size %d; got %v; want %v", bufSize, err, io.ErrUnexpectedEOF)
+		}
+		zr.Release()
+	}
+
+	// Mix small and large reads in single-frame mode.
+	zr := NewReaderParams(bytes.NewReader(src), &ReaderParams{SingleFrame: true})
+	defer zr.Release()
+	var plainData []byte
+	for i := 0; ; i++ {
+		buf := make([]byte, 1+(i%3)*int(dstreamOutBufSize))
+		n, err := zr.Read(buf)
+		plainData = append(plainData, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("cannot read data in single-frame mode: %s", err)
+		}
+	}
+	if string(plainData) != data {
+		t.Fatalf("unexpected data read in single-frame mode")
+	}
+	if n := zr.ConsumedBytes(); n != int64(len(cd)) {
+		t.Fatalf("unexpected number of consumed bytes; got %d; want %d", n, len(cd))
+	}
+}
+
+func TestReaderParamsContext(t *testing.T) {
+	data := newTestString(1024*1024, 3)
+	cd := mustCompressWriter(t, data)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	zr := NewReaderParams(bytes.NewReader(cd), &ReaderParams{Context: ctx})
+	defer zr.Release()
+	buf := make([]byte, 1024)
+	if _, err := io.ReadFull(zr, buf); err != nil {
+		t.Fatalf("cannot read data: %s", err)
+	}
+	cancel()
+
+	// The data decompressed before the cancelation may be still returned.
+	var err error
+	for i := 0; i < len(data)/len(buf) && err == nil; i++ {
+		_, err = zr.Read(buf)
+	}
+	if err != context.Canceled {
+		t.Fatalf("unexpected error; got %v; want %v", err, context.Canceled)
+	}
+	if _, err := zr.Read(buf); err != context.Canceled {
+		t.Fatalf("unexpected error on the next read; got %v; want %v", err, context.Canceled)
+	}
+
+	// ResetReaderParams with the done context mustn't make the reader usable.
+	zr.ResetReaderParams(bytes.NewReader(cd), &ReaderParams{Context: ctx})
+	if _, err := ioutil.ReadAll(zr); err != context.Canceled {
+		t.Fatalf("unexpected error after ResetReaderParams; got %v; want %v", err, context.Canceled)
+	}
+
+	// The reader must be usable after Reset, which drops the context,
+	// and after resetting the context.
+	for _, reset := range []func(){
+		func() { zr.Reset(bytes.NewReader(cd), nil) },
+		func() { zr.ResetReaderParams(bytes.NewReader(cd), &ReaderParams{Context: context.Background()}) },
+	} {
+		reset()
+		plainData, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("cannot read data: %s", err)
+		}
+		if string(plainData) != data {
+			t.Fatalf("unexpected data read")
+		}
+	}
+}
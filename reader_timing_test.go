@@ -87,3 +87,11 @@ func benchmarkReader(b *testing.B, blockSize, level int) {
 		}
 	})
 }
+
+func BenchmarkReaderLargeBlocks(b *testing.B) {
+	for _, blockSize := range benchLargeBlockSizes {
+		b.Run(fmt.Sprintf("blockSize_%d", blockSize), func(b *testing.B) {
+			benchmarkReader(b, blockSize, 1)
+		})
+	}
+}
@@ -0,0 +1,526 @@
+package gozstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// The seekable format is described at
+// https://github.com/facebook/zstd/blob/dev/contrib/seekable_format/zstd_seekable_compression_format.md .
+//
+// The data consists of independent zstd frames followed by a seek table
+// stored in a skippable frame. The seek table contains compressed and
+// decompressed sizes for every frame, so the frame containing the given
+// offset may be located without decompressing the preceding frames.
+
+const (
+	// seekTableMagicVariant is the skippable frame magic variant for the seek table.
+	seekTableMagicVariant = 0xE
+
+	skippableHeaderSize = 8 // Obtained from ZSTD_SKIPPABLEHEADERSIZE.
+
+	seekTableFooterMagic = 0x8F92EAB1
+	seekTableFooterSize  = 9
+
+	seekTableChecksumFlag  = 1 << 7
+	seekTableReservedFlags = 0x7C
+
+	seekableMaxFrames = 0x8000000
+)
+
+// DefaultSeekableFrameSize is the default size of decompressed data
+// in a single frame written by SeekableWriter.
+const DefaultSeekableFrameSize = 1 << 20
+
+// MaxSeekableFrameSize is the maximum size of decompressed data
+// in a single frame written by SeekableWriter.
+const MaxSeekableFrameSize = 1 << 30
+
+// ErrInvalidSeekTable is returned when the seek table of seekable data
+// is missing or corrupted.
+var ErrInvalidSeekTable = errors.New("invalid seek table")
+
+type seekTableEntry struct {
+	compressedSize   uint32
+	decompressedSize uint32
+}
+
+// SeekableWriter implements zstd writer for the seekable format.
+//
+// It cuts a new frame every frameSize bytes of the written data
+// and appends the seek table on Close. Use SeekableReader for random
+// access to the written data.
+type SeekableWriter struct {
+	zw *Writer
+	cw countingWriter
+
+	frameSize    int
+	decompressed int
+	compressed   int64
+
+	entries []seekTableEntry
+	err     error
+}
+
+// NewSeekableWriter returns new zstd writer for the seekable format.
+//
+// The writer writes compressed data to w, cutting a new frame every frameSize
+// bytes of the written data. Smaller frames improve random access speed
+// at the cost of compression ratio. Special value 0 means
+// DefaultSeekableFrameSize. params are used for compressing the frames;
+// nil params mean default parameters. params.FrameSize must be 0, since
+// the frames are cut by sw.
+//
+// Invalid frameSize or params result in error returned from the first
+// Write, Flush or Close call.
+//
+// Call Close for writing the seek table when all the data is written.
+// Call Release when the SeekableWriter is no longer needed.
+func NewSeekableWriter(w io.Writer, frameSize int, params *WriterParams) *SeekableWriter {
+	if frameSize == 0 {
+		frameSize = DefaultSeekableFrameSize
+	}
+	sw := &SeekableWriter{
+		frameSize: frameSize,
+	}
+	sw.cw.w = w
+	sw.zw = NewWriterParams(&sw.cw, params)
+	if frameSize < 0 || frameSize > MaxSeekableFrameSize {
+		sw.err = fmt.Errorf("frameSize must be in the range [1..%d]; got %d", MaxSeekableFrameSize, frameSize)
+	} else if params != nil && params.FrameSize != 0 {
+		// Frames cut by sw.zw would be missing in the seek table.
+		sw.err = fmt.Errorf("WriterParams.FrameSize cannot be set for SeekableWriter; got %d; pass frameSize instead", params.FrameSize)
+	}
+	return sw
+}
+
+// Write writes p to sw.
+func (sw *SeekableWriter) Write(p []byte) (int, error) {
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	nn := 0
+	for len(p) > 0 {
+		n := sw.frameSize - sw.decompressed
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := sw.zw.Write(p[:n]); err != nil {
+			sw.err = err
+			return nn, err
+		}
+		sw.decompressed += n
+		nn += n
+		p = p[n:]
+		if sw.decompressed == sw.frameSize {
+			if err := sw.endFrame(); err != nil {
+				return nn, err
+			}
+		}
+	}
+	return nn, nil
+}
+
+// Flush flushes the remaining data from sw to the underlying writer.
+//
+// Flush doesn't end the current frame.
+func (sw *SeekableWriter) Flush() error {
+	if sw.err != nil {
+		return sw.err
+	}
+	if err := sw.zw.Flush(); err != nil {
+		sw.err = err
+		return err
+	}
+	return nil
+}
+
+// Close ends the current frame and writes the seek table
+// to the underlying writer.
+//
+// It doesn't close the underlying writer.
+// sw cannot be written to after Close.
+func (sw *SeekableWriter) Close() error {
+	if sw.err != nil {
+		return sw.err
+	}
+	if sw.decompressed > 0 {
+		if err := sw.endFrame(); err != nil {
+			return err
+		}
+	}
+
+	seekTable := marshalSeekTable(nil, sw.entries)
+	if _, err := sw.cw.Write(seekTable); err != nil {
+		sw.err = fmt.Errorf("cannot write seek table: %w", err)
+		return sw.err
+	}
+	sw.err = errors.New("cannot write to closed SeekableWriter")
+	return nil
+}
+
+func (sw *SeekableWriter) endFrame() error {
+	if len(sw.entries) >= seekableMaxFrames {
+		sw.err = fmt.Errorf("too many frames; cannot write more than %d frames", seekableMaxFrames)
+		return sw.err
+	}
+	if err := sw.zw.EndFrame(); err != nil {
+		sw.err = err
+		return err
+	}
+	sw.entries = append(sw.entries, seekTableEntry{
+		compressedSize:   uint32(sw.cw.n - sw.compressed),
+		decompressedSize: uint32(sw.decompressed),
+	})
+	sw.compressed = sw.cw.n
+	sw.decompressed = 0
+	return nil
+}
+
+// Release releases all the resources occupied by sw.
+//
+// sw cannot be used after the release.
+func (sw *SeekableWriter) Release() {
+	if sw.zw == nil {
+		return
+	}
+	sw.zw.Release()
+	sw.zw = nil
+	sw.cw.w = nil
+	sw.entries = nil
+	sw.err = nil
+}
+
+func marshalSeekTable(dst []byte, entries []seekTableEntry) []byte {
+	var buf [8]byte
+	payload := make([]byte, 0, len(entries)*len(buf)+seekTableFooterSize)
+	for _, e := range entries {
+		binary.LittleEndian.PutUint32(buf[:4], e.compressedSize)
+		binary.LittleEndian.PutUint32(buf[4:], e.decompressedSize)
+		payload = append(payload, buf[:]...)
+	}
+	binary.LittleEndian.PutUint32(buf[:4], uint32(len(entries)))
+	payload = append(payload, buf[:4]...)
+	// Seek table descriptor without checksums.
+	payload = append(payload, 0)
+	binary.LittleEndian.PutUint32(buf[:4], seekTableFooterMagic)
+	payload = append(payload, buf[:4]...)
+
+	dst, err := AppendSkippableFrame(dst, seekTableMagicVariant, payload)
+	if err != nil {
+		panic(fmt.Errorf("BUG: cannot write seek table: %w", err))
+	}
+	return dst
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+type seekableFrame struct {
+	compressedOffset   int64
+	decompressedOffset int64
+	compressedSize     int
+	decompressedSize   int
+}
+
+// SeekableReader provides random access to data in the seekable format.
+//
+// Only the frames containing the requested data are read
+// from the underlying io.ReaderAt and decompressed.
+//
+// SeekableReader implements io.ReaderAt, io.ReadSeeker and io.WriterTo.
+// Concurrent ReadAt calls are allowed, while Read, Seek and WriteTo
+// mustn't be called concurrently.
+type SeekableReader struct {
+	r      io.ReaderAt
+	dd     *DDict
+	frames []seekableFrame
+	size   int64
+
+	offset int64
+
+	// mu protects lastFrame. It isn't held during frame decompression,
+	// so concurrent ReadAt calls decompress frames in parallel.
+	mu        sync.Mutex
+	lastFrame *seekableFrameData
+
+	// compressedPool contains buffers for reading compressed frames.
+	compressedPool sync.Pool
+}
+
+// seekableFrameData is the decompressed frame.
+//
+// It is immutable, so it may be read concurrently.
+type seekableFrameData struct {
+	idx  int
+	data []byte
+}
+
+// NewSeekableReader returns new reader for data in the seekable format
+// with the given size stored in r.
+//
+// The optional dictionary dd is used for decompressing the frames.
+func NewSeekableReader(r io.ReaderAt, size int64, dd *DDict) (*SeekableReader, error) {
+	frames, err := readSeekTable(r, size)
+	if err != nil {
+		return nil, err
+	}
+	sr := &SeekableReader{
+		r:      r,
+		dd:     dd,
+		frames: frames,
+	}
+	if len(frames) > 0 {
+		last := &frames[len(frames)-1]
+		sr.size = last.decompressedOffset + int64(last.decompressedSize)
+	}
+	return sr, nil
+}
+
+// readFullAt reads len(p) bytes from r at offset off.
+//
+// io.ReaderAt may return io.EOF together with len(p) bytes
+// when the read ends at the end of input, so io.EOF is ignored in this case.
+func readFullAt(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func readSeekTable(r io.ReaderAt, size int64) ([]seekableFrame, error) {
+	if size < skippableHeaderSize+seekTableFooterSize {
+		return nil, fmt.Errorf("too small data size %d for the seek table: %w", size, ErrInvalidSeekTable)
+	}
+	var footer [seekTableFooterSize]byte
+	if err := readFullAt(r, footer[:], size-seekTableFooterSize); err != nil {
+		return nil, fmt.Errorf("cannot read seek table footer: %w", err)
+	}
+	if magic := binary.LittleEndian.Uint32(footer[5:]); magic != seekTableFooterMagic {
+		return nil, fmt.Errorf("unexpected seek table footer magic 0x%08X: %w", magic, ErrInvalidSeekTable)
+	}
+	framesCount := binary.LittleEndian.Uint32(footer[:4])
+	if framesCount > seekableMaxFrames {
+		return nil, fmt.Errorf("too many frames in the seek table: %d: %w", framesCount, ErrInvalidSeekTable)
+	}
+	descriptor := footer[4]
+	if descriptor&seekTableReservedFlags != 0 {
+		return nil, fmt.Errorf("unexpected reserved bits in seek table descriptor 0x%02X: %w", descriptor, ErrInvalidSeekTable)
+	}
+	entrySize := 8
+	if descriptor&seekTableChecksumFlag != 0 {
+		// Checksums aren't verified.
+		entrySize = 12
+	}
+
+	frameSize := int64(skippableHeaderSize) + int64(framesCount)*int64(entrySize) + seekTableFooterSize
+	if frameSize > size {
+		return nil, fmt.Errorf("seek table size %d exceeds data size %d: %w", frameSize, size, ErrInvalidSeekTable)
+	}
+	seekTable := make([]byte, frameSize)
+	if err := readFullAt(r, seekTable, size-frameSize); err != nil {
+		return nil, fmt.Errorf("cannot read seek table: %w", err)
+	}
+	fh, err := ParseFrameHeader(seekTable)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse seek table frame header: %w: %s", ErrInvalidSeekTable, err)
+	}
+	if fh.Type != FrameTypeSkippable || fh.MagicVariant != seekTableMagicVariant || fh.ContentSize != uint64(frameSize-skippableHeaderSize) {
+		return nil, fmt.Errorf("unexpected seek table frame header %+v: %w", fh, ErrInvalidSeekTable)
+	}
+
+	entries := seekTable[skippableHeaderSize:]
+	frames := make([]seekableFrame, framesCount)
+	var compressedOffset, decompressedOffset int64
+	for i := range frames {
+		compressedSize := binary.LittleEndian.Uint32(entries)
+		decompressedSize := binary.LittleEndian.Uint32(entries[4:])
+		entries = entries[entrySize:]
+		if decompressedSize > MaxSeekableFrameSize {
+			return nil, fmt.Errorf("too big decompressed size %d for frame #%d: %w", decompressedSize, i, ErrInvalidSeekTable)
+		}
+		if decompressedSize == 0 && compressedSize > 0 {
+			// SeekableWriter doesn't write empty frames. Reject such entries,
+			// since zero size means 'no limit' for the frame decompression.
+			return nil, fmt.Errorf("zero decompressed size for non-empty frame #%d: %w", i, ErrInvalidSeekTable)
+		}
+		frames[i] = seekableFrame{
+			compressedOffset:   compressedOffset,
+			decompressedOffset: decompressedOffset,
+			compressedSize:     int(compressedSize),
+			decompressedSize:   int(decompressedSize),
+		}
+		compressedOffset += int64(compressedSize)
+		decompressedOffset += int64(decompressedSize)
+	}
+	if compressedOffset != size-frameSize {
+		return nil, fmt.Errorf("compressed frames size %d in the seek table doesn't match the actual size %d: %w",
+			compressedOffset, size-frameSize, ErrInvalidSeekTable)
+	}
+	return frames, nil
+}
+
+// Size returns the size of the decompressed data.
+func (sr *SeekableReader) Size() int64 {
+	return sr.size
+}
+
+// NumFrames returns the number of frames in the data.
+func (sr *SeekableReader) NumFrames() int {
+	return len(sr.frames)
+}
+
+// ReadAt reads len(p) bytes of decompressed data starting at offset off.
+func (sr *SeekableReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= sr.size {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+
+	idx := sr.frameIndex(off)
+	nn := 0
+	for nn < len(p) && idx < len(sr.frames) {
+		fd, err := sr.loadFrame(idx)
+		if err != nil {
+			return nn, err
+		}
+		f := &sr.frames[idx]
+		n := copy(p[nn:], fd.data[off-f.decompressedOffset:])
+		nn += n
+		off += int64(n)
+		idx++
+	}
+	if nn < len(p) {
+		return nn, io.EOF
+	}
+	return nn, nil
+}
+
+// frameIndex returns the index of the frame containing the offset off.
+func (sr *SeekableReader) frameIndex(off int64) int {
+	return sort.Search(len(sr.frames), func(i int) bool {
+		f := &sr.frames[i]
+		return f.decompressedOffset+int64(f.decompressedSize) > off
+	})
+}
+
+// loadFrame returns the decompressed frame with the given idx.
+//
+// The last decompressed frame is cached, so sequential reads
+// do not decompress the same frame multiple times.
+func (sr *SeekableReader) loadFrame(idx int) (*seekableFrameData, error) {
+	sr.mu.Lock()
+	fd := sr.lastFrame
+	sr.mu.Unlock()
+	if fd != nil && fd.idx == idx {
+		return fd, nil
+	}
+
+	f := &sr.frames[idx]
+	var compressed []byte
+	if v := sr.compressedPool.Get(); v != nil {
+		compressed = *v.(*[]byte)
+	}
+	if cap(compressed) < f.compressedSize {
+		compressed = make([]byte, f.compressedSize)
+	}
+	compressed = compressed[:f.compressedSize]
+	defer sr.compressedPool.Put(&compressed)
+	if err := readFullAt(sr.r, compressed, f.compressedOffset); err != nil {
+		return nil, fmt.Errorf("cannot read frame #%d at offset %d: %w", idx, f.compressedOffset, err)
+	}
+
+	opts := &DecompressOptions{
+		Dict:                sr.dd,
+		MaxDecompressedSize: int64(f.decompressedSize),
+	}
+	data, err := DecompressWithOptions(make([]byte, 0, f.decompressedSize), compressed, opts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress frame #%d at offset %d: %w", idx, f.compressedOffset, err)
+	}
+	if len(data) != f.decompressedSize {
+		return nil, fmt.Errorf("unexpected decompressed size for frame #%d at offset %d; got %d; want %d: %w",
+			idx, f.compressedOffset, len(data), f.decompressedSize, ErrInvalidSeekTable)
+	}
+
+	fd = &seekableFrameData{
+		idx:  idx,
+		data: data,
+	}
+	sr.mu.Lock()
+	sr.lastFrame = fd
+	sr.mu.Unlock()
+	return fd, nil
+}
+
+// Read reads up to len(p) bytes from sr to p.
+func (sr *SeekableReader) Read(p []byte) (int, error) {
+	n, err := sr.ReadAt(p, sr.offset)
+	sr.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		// Return io.EOF on the next call.
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the offset for the next Read.
+func (sr *SeekableReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += sr.offset
+	case io.SeekEnd:
+		offset += sr.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %d", offset)
+	}
+	sr.offset = offset
+	return offset, nil
+}
+
+// WriteTo writes the remaining decompressed data from sr to w.
+//
+// It returns the number of bytes written to w.
+func (sr *SeekableReader) WriteTo(w io.Writer) (int64, error) {
+	nn := int64(0)
+	for sr.offset < sr.size {
+		idx := sr.frameIndex(sr.offset)
+		fd, err := sr.loadFrame(idx)
+		if err != nil {
+			return nn, err
+		}
+		buf := fd.data[sr.offset-sr.frames[idx].decompressedOffset:]
+		n, err := w.Write(buf)
+		sr.offset += int64(n)
+		nn += int64(n)
+		if err != nil {
+			return nn, err
+		}
+	}
+	return nn, nil
+}
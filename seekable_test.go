@@ -0,0 +1,453 @@
+package gozstd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSeekableWriterReader(t *testing.T) {
+	for _, frameSize := range []int{1, 100, 4096, 64 * 1024, 0} {
+		for _, size := range []int{0, 1, 100, 5000, 300 * 1024} {
+			if frameSize == 1 && size > 5000 {
+				// Too slow.
+				continue
+			}
+			t.Run(fmt.Sprintf("frameSize_%d_size_%d", frameSize, size), func(t *testing.T) {
+				src := []byte(newTestString(size, 10))
+				testSeekableRoundtrip(t, src, frameSize)
+			})
+		}
+	}
+}
+
+func testSeekableRoundtrip(t *testing.T, src []byte, frameSize int) {
+	t.Helper()
+
+	var bb bytes.Buffer
+	sw := NewSeekableWriter(&bb, frameSize, &WriterParams{
+		CompressionLevel: 5,
+	})
+	defer sw.Release()
+	if err := testSeekableWriterWrite(sw, src); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("cannot close SeekableWriter: %s", err)
+	}
+
+	// The seekable data must be decompressible by the regular decompressor.
+	plainData, err := Decompress(nil, bb.Bytes())
+	if err != nil {
+		t.Fatalf("cannot decompress seekable data: %s", err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected data decompressed with Decompress")
+	}
+
+	compressedData := bb.Bytes()
+	sr, err := NewSeekableReader(bytes.NewReader(compressedData), int64(len(compressedData)), nil)
+	if err != nil {
+		t.Fatalf("cannot create SeekableReader: %s", err)
+	}
+	if sr.Size() != int64(len(src)) {
+		t.Fatalf("unexpected size; got %d; want %d", sr.Size(), len(src))
+	}
+	if frameSize == 0 {
+		frameSize = DefaultSeekableFrameSize
+	}
+	framesExpected := (len(src) + frameSize - 1) / frameSize
+	if sr.NumFrames() != framesExpected {
+		t.Fatalf("unexpected number of frames; got %d; want %d", sr.NumFrames(), framesExpected)
+	}
+
+	// Sequential read.
+	plainData, err = ioutil.ReadAll(sr)
+	if err != nil {
+		t.Fatalf("cannot read data: %s", err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected data read from SeekableReader")
+	}
+
+	// Random access.
+	for i := 0; i < 100 && len(src) > 0; i++ {
+		off := rand.Intn(len(src))
+		n := rand.Intn(len(src)-off) + 1
+		buf := make([]byte, n)
+		if _, err := sr.ReadAt(buf, int64(off)); err != nil {
+			t.Fatalf("cannot read %d bytes at offset %d: %s", n, off, err)
+		}
+		if !bytes.Equal(buf, src[off:off+n]) {
+			t.Fatalf("unexpected data at offset %d", off)
+		}
+
+		if _, err := sr.Seek(int64(off), io.SeekStart); err != nil {
+			t.Fatalf("cannot seek to %d: %s", off, err)
+		}
+		var out bytes.Buffer
+		if _, err := io.Copy(&out, sr); err != nil {
+			t.Fatalf("cannot copy data from offset %d: %s", off, err)
+		}
+		if !bytes.Equal(out.Bytes(), src[off:]) {
+			t.Fatalf("unexpected data copied from offset %d", off)
+		}
+	}
+}
+
+func testSeekableWriterWrite(sw *SeekableWriter, src []byte) error {
+	for len(src) > 0 {
+		n := rand.Intn(len(src)) + 1
+		if _, err := sw.Write(src[:n]); err != nil {
+			return err
+		}
+		src = src[n:]
+		if rand.Intn(10) == 0 {
+			if err := sw.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestSeekableReaderReadAtEOF(t *testing.T) {
+	src := []byte("foobarbaz")
+	var bb bytes.Buffer
+	sw := NewSeekableWriter(&bb, 4, nil)
+	defer sw.Release()
+	if _, err := sw.Write(src); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("cannot close SeekableWriter: %s", err)
+	}
+	if _, err := sw.Write(src); err == nil {
+		t.Fatalf("expecting non-nil error when writing to closed SeekableWriter")
+	}
+
+	sr, err := NewSeekableReader(bytes.NewReader(bb.Bytes()), int64(bb.Len()), nil)
+	if err != nil {
+		t.Fatalf("cannot create SeekableReader: %s", err)
+	}
+	buf := make([]byte, 5)
+	n, err := sr.ReadAt(buf, 6)
+	if err != io.EOF {
+		t.Fatalf("unexpected error; got %v; want %v", err, io.EOF)
+	}
+	if string(buf[:n]) != "baz" {
+		t.Fatalf("unexpected data; got %q; want %q", buf[:n], "baz")
+	}
+	if _, err := sr.ReadAt(buf, 100); err != io.EOF {
+		t.Fatalf("unexpected error for offset beyond the end; got %v; want %v", err, io.EOF)
+	}
+	if _, err := sr.ReadAt(buf, -1); err == nil {
+		t.Fatalf("expecting non-nil error for negative offset")
+	}
+
+	off, err := sr.Seek(-3, io.SeekEnd)
+	if err != nil {
+		t.Fatalf("cannot seek from the end: %s", err)
+	}
+	if off != 6 {
+		t.Fatalf("unexpected offset; got %d; want 6", off)
+	}
+	if _, err := sr.Seek(-7, io.SeekCurrent); err == nil {
+		t.Fatalf("expecting non-nil error for negative offset")
+	}
+}
+
+func TestSeekableReaderDict(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf("seekable sample %d", i)))
+	}
+	dict := BuildDict(samples, 8*1024)
+	cd, err := NewCDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	defer cd.Release()
+	dd, err := NewDDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create DDict: %s", err)
+	}
+	defer dd.Release()
+
+	var bb bytes.Buffer
+	sw := NewSeekableWriter(&bb, 100, &WriterParams{
+		Dict: cd,
+	})
+	defer sw.Release()
+	var src []byte
+	for i := 0; i < 100; i++ {
+		src = append(src, fmt.Sprintf("seekable sample %d", i)...)
+	}
+	if _, err := sw.Write(src); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("cannot close SeekableWriter: %s", err)
+	}
+
+	sr, err := NewSeekableReader(bytes.NewReader(bb.Bytes()), int64(bb.Len()), dd)
+	if err != nil {
+		t.Fatalf("cannot create SeekableReader: %s", err)
+	}
+	buf := make([]byte, 50)
+	if _, err := sr.ReadAt(buf, 1000); err != nil {
+		t.Fatalf("cannot read data: %s", err)
+	}
+	if !bytes.Equal(buf, src[1000:1050]) {
+		t.Fatalf("unexpected data; got %q; want %q", buf, src[1000:1050])
+	}
+
+	sr, err = NewSeekableReader(bytes.NewReader(bb.Bytes()), int64(bb.Len()), nil)
+	if err != nil {
+		t.Fatalf("cannot create SeekableReader: %s", err)
+	}
+	if _, err := sr.ReadAt(buf, 1000); !errors.Is(err, ErrDictionaryWrong) {
+		t.Fatalf("unexpected error without dict; got %v; want %v", err, ErrDictionaryWrong)
+	}
+}
+
+func TestSeekableReaderInvalidSeekTable(t *testing.T) {
+	src := []byte(newTestString(10000, 10))
+	var bb bytes.Buffer
+	sw := NewSeekableWriter(&bb, 1000, nil)
+	defer sw.Release()
+	if _, err := sw.Write(src); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("cannot close SeekableWriter: %s", err)
+	}
+	data := bb.Bytes()
+
+	f := func(data []byte) {
+		t.Helper()
+		_, err := NewSeekableReader(bytes.NewReader(data), int64(len(data)), nil)
+		if !errors.Is(err, ErrInvalidSeekTable) {
+			t.Fatalf("unexpected error; got %v; want %v", err, ErrInvalidSeekTable)
+		}
+	}
+
+	// Missing seek table.
+	f(Compress(nil, src))
+	f(nil)
+
+	// Corrupted footer magic.
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)-1]++
+	f(corrupted)
+
+	// Reserved bits in the descriptor.
+	corrupted = append([]byte{}, data...)
+	corrupted[len(corrupted)-5] = 0x04
+	f(corrupted)
+
+	// Wrong number of frames.
+	corrupted = append([]byte{}, data...)
+	corrupted[len(corrupted)-9]++
+	f(corrupted)
+
+	// Zero decompressed size for the first frame.
+	corrupted = append([]byte{}, data...)
+	seekTableSize := skippableHeaderSize + 10*8 + seekTableFooterSize
+	entry := corrupted[len(corrupted)-seekTableSize+skippableHeaderSize:]
+	binary.LittleEndian.PutUint32(entry[4:], 0)
+	f(corrupted)
+
+	// Extra data before the frames.
+	f(append([]byte("prefix"), data...))
+}
+
+func TestSeekableWriterInvalidFrameSize(t *testing.T) {
+	for _, frameSize := range []int{-1, MaxSeekableFrameSize + 1} {
+		sw := NewSeekableWriter(ioutil.Discard, frameSize, nil)
+		if _, err := sw.Write([]byte("foo")); err == nil {
+			t.Fatalf("expecting non-nil error for frameSize=%d", frameSize)
+		}
+		if err := sw.Close(); err == nil {
+			t.Fatalf("expecting non-nil error on Close for frameSize=%d", frameSize)
+		}
+		sw.Release()
+	}
+
+	// WriterParams.FrameSize would cut frames missing in the seek table.
+	sw := NewSeekableWriter(ioutil.Discard, 1000, &WriterParams{FrameSize: 100})
+	defer sw.Release()
+	if _, err := sw.Write([]byte("foo")); err == nil {
+		t.Fatalf("expecting non-nil error for WriterParams.FrameSize")
+	}
+}
+
+func TestSeekableReaderConcurrent(t *testing.T) {
+	src := []byte(newTestString(200*1024, 10))
+	var bb bytes.Buffer
+	sw := NewSeekableWriter(&bb, 8*1024, nil)
+	defer sw.Release()
+	if _, err := sw.Write(src); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("cannot close SeekableWriter: %s", err)
+	}
+	sr, err := NewSeekableReader(bytes.NewReader(bb.Bytes()), int64(bb.Len()), nil)
+	if err != nil {
+		t.Fatalf("cannot create SeekableReader: %s", err)
+	}
+
+	concurrency := 5
+	ch := make(chan error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			buf := make([]byte, 1000)
+			for j := 0; j < 100; j++ {
+				off := rand.Intn(len(src) - len(buf))
+				if _, err := sr.ReadAt(buf, int64(off)); err != nil {
+					ch <- err
+					return
+				}
+				if !bytes.Equal(buf, src[off:off+len(buf)]) {
+					ch <- fmt.Errorf("unexpected data at offset %d", off)
+					return
+				}
+			}
+			ch <- nil
+		}()
+	}
+	for i := 0; i < concurrency; i++ {
+		if err := <-ch; err != nil {
+			t.Fatalf("error in concurrent ReadAt: %s", err)
+		}
+	}
+}
+
+// eofReaderAt returns io.EOF together with the data read up to the end
+// of input, as allowed by io.ReaderAt contract.
+type eofReaderAt struct {
+	data []byte
+}
+
+func (r *eofReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[off:])
+	if off+int64(n) == int64(len(r.data)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestSeekableReaderEOFReaderAt(t *testing.T) {
+	src := []byte(newTestString(100*1024, 10))
+	var bb bytes.Buffer
+	sw := NewSeekableWriter(&bb, 8*1024, nil)
+	defer sw.Release()
+	if err := testSeekableWriterWrite(sw, src); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("cannot close SeekableWriter: %s", err)
+	}
+	data := bb.Bytes()
+
+	sr, err := NewSeekableReader(&eofReaderAt{data: data}, int64(len(data)), nil)
+	if err != nil {
+		t.Fatalf("cannot create SeekableReader: %s", err)
+	}
+	buf := make([]byte, len(src))
+	if _, err := sr.ReadAt(buf, 0); err != nil {
+		t.Fatalf("cannot read data: %s", err)
+	}
+	if !bytes.Equal(buf, src) {
+		t.Fatalf("unexpected data read")
+	}
+
+	// Truncated data must be detected.
+	_, err = NewSeekableReader(&eofReaderAt{data: data[:len(data)-1]}, int64(len(data)), nil)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("unexpected error for truncated data; got %v; want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+// barrierReaderAt blocks ReadAt calls until the given number of calls
+// run concurrently.
+type barrierReaderAt struct {
+	data []byte
+
+	mu      sync.Mutex
+	calls   int
+	readyCh chan struct{}
+}
+
+func (r *barrierReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	r.calls--
+	if r.calls == 0 {
+		close(r.readyCh)
+	}
+	r.mu.Unlock()
+	select {
+	case <-r.readyCh:
+	case <-time.After(5 * time.Second):
+		return 0, fmt.Errorf("timeout when waiting for concurrent ReadAt calls")
+	}
+	return bytes.NewReader(r.data).ReadAt(p, off)
+}
+
+func TestSeekableReaderParallelReadAt(t *testing.T) {
+	const frameSize = 8 * 1024
+	src := []byte(newTestString(4*frameSize, 10))
+	var bb bytes.Buffer
+	sw := NewSeekableWriter(&bb, frameSize, nil)
+	defer sw.Release()
+	if _, err := sw.Write(src); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("cannot close SeekableWriter: %s", err)
+	}
+	data := bb.Bytes()
+
+	sr, err := NewSeekableReader(bytes.NewReader(data), int64(len(data)), nil)
+	if err != nil {
+		t.Fatalf("cannot create SeekableReader: %s", err)
+	}
+	// ReadAt calls for distinct frames mustn't wait for each other.
+	const concurrency = 4
+	sr.r = &barrierReaderAt{
+		data:    data,
+		calls:   concurrency,
+		readyCh: make(chan struct{}),
+	}
+	ch := make(chan error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func(off int) {
+			buf := make([]byte, frameSize)
+			if _, err := sr.ReadAt(buf, int64(off)); err != nil {
+				ch <- err
+				return
+			}
+			if !bytes.Equal(buf, src[off:off+frameSize]) {
+				ch <- fmt.Errorf("unexpected data read at offset %d", off)
+				return
+			}
+			ch <- nil
+		}(i * frameSize)
+	}
+	for i := 0; i < concurrency; i++ {
+		if err := <-ch; err != nil {
+			t.Fatalf("error in concurrent ReadAt: %s", err)
+		}
+	}
+}
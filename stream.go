@@ -1,6 +1,7 @@
 package gozstd
 
 import (
+	"context"
 	"io"
 	"sync"
 )
@@ -32,6 +33,43 @@ func StreamCompressDict(dst io.Writer, src io.Reader, cd *CDict) error {
 	return streamCompressDictLevel(dst, src, cd, 0)
 }
 
+// StreamCompressParams compresses src into dst using the given set of parameters.
+//
+// Set params.Workers for compressing src in multiple threads.
+//
+// This function doesn't work with interactive network streams, since data read
+// from src may be buffered before passing to dst for performance reasons.
+// Use Writer.Flush for interactive network streams.
+func StreamCompressParams(dst io.Writer, src io.Reader, params *WriterParams) error {
+	if params == nil {
+		params = &WriterParams{}
+	}
+	sc := getSCompressor(params.CompressionLevel)
+	sc.zw.ResetWriterParams(dst, params)
+	_, err := sc.zw.ReadFrom(src)
+	if err == nil {
+		err = sc.zw.Close()
+	}
+	putSCompressor(sc)
+	return err
+}
+
+// StreamCompressContext compresses src into dst until src ends or ctx is done.
+//
+// ctx.Err() is returned if ctx is done before the compression ends.
+// Use WriterParams.Context for canceling StreamCompressParams.
+//
+// This function doesn't work with interactive network streams, since data read
+// from src may be buffered before passing to dst for performance reasons.
+// Use Writer.Flush for interactive network streams.
+func StreamCompressContext(ctx context.Context, dst io.Writer, src io.Reader) error {
+	params := &WriterParams{
+		CompressionLevel: DefaultCompressionLevel,
+		Context:          ctx,
+	}
+	return StreamCompressParams(dst, src, params)
+}
+
 func streamCompressDictLevel(dst io.Writer, src io.Reader, cd *CDict, compressionLevel int) error {
 	sc := getSCompressor(compressionLevel)
 	sc.zw.Reset(dst, cd, compressionLevel)
@@ -61,7 +99,11 @@ func getSCompressor(compressionLevel int) *sCompressor {
 }
 
 func putSCompressor(sc *sCompressor) {
-	sc.zw.Reset(nil, nil, sc.compressionLevel)
+	// Drop the parameters set by StreamCompressParams.
+	params := WriterParams{
+		CompressionLevel: sc.compressionLevel,
+	}
+	sc.zw.ResetWriterParams(nil, &params)
 	p := getSCompressorPool(sc.compressionLevel)
 	p.Put(sc)
 }
@@ -99,8 +141,40 @@ func StreamDecompress(dst io.Writer, src io.Reader) error {
 // from src may be buffered before passing to dst for performance reasons.
 // Use Reader for interactive network streams.
 func StreamDecompressDict(dst io.Writer, src io.Reader, dd *DDict) error {
+	params := &ReaderParams{
+		Dict: dd,
+	}
+	return StreamDecompressParams(dst, src, params)
+}
+
+// StreamDecompressContext decompresses src into dst until src ends or ctx
+// is done.
+//
+// ctx.Err() is returned if ctx is done before the decompression ends.
+// Use ReaderParams.Context for canceling StreamDecompressParams.
+//
+// This function doesn't work with interactive network streams, since data read
+// from src may be buffered before passing to dst for performance reasons.
+// Use Reader for interactive network streams.
+func StreamDecompressContext(ctx context.Context, dst io.Writer, src io.Reader) error {
+	params := &ReaderParams{
+		Context: ctx,
+	}
+	return StreamDecompressParams(dst, src, params)
+}
+
+// StreamDecompressParams decompresses src into dst using the given set
+// of parameters.
+//
+// This function doesn't work with interactive network streams, since data read
+// from src may be buffered before passing to dst for performance reasons.
+// Use Reader for interactive network streams.
+func StreamDecompressParams(dst io.Writer, src io.Reader, params *ReaderParams) error {
+	if params == nil {
+		params = &ReaderParams{}
+	}
 	sd := getSDecompressor()
-	sd.zr.Reset(src, dd)
+	sd.zr.ResetReaderParams(src, params)
 	_, err := sd.zr.WriteTo(dst)
 	putSDecompressor(sd)
 	return err
@@ -121,7 +195,7 @@ func getSDecompressor() *sDecompressor {
 }
 
 func putSDecompressor(sd *sDecompressor) {
-	sd.zr.Reset(nil, nil)
+	sd.zr.ResetReaderParams(nil, &ReaderParams{})
 	sDecompressorPool.Put(sd)
 }
 
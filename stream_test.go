@@ -2,7 +2,10 @@ package gozstd
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"testing"
 	"time"
 )
@@ -121,6 +124,112 @@ func testStreamCompressDecompressLevelSerial(data string, level int) error {
 	return nil
 }
 
+func TestStreamCompressParams(t *testing.T) {
+	data := newTestString(1024*1024, 3)
+	paramsList := []*WriterParams{
+		nil,
+		{CompressionLevel: 5},
+		{Workers: 3, JobSize: 256 * 1024},
+	}
+	for _, params := range paramsList {
+		var bbCompress bytes.Buffer
+		if err := StreamCompressParams(&bbCompress, bytes.NewBufferString(data), params); err != nil {
+			t.Fatalf("cannot compress stream with %+v: %s", params, err)
+		}
+		var bbDecompress bytes.Buffer
+		if err := StreamDecompress(&bbDecompress, &bbCompress); err != nil {
+			t.Fatalf("cannot decompress stream compressed with %+v: %s", params, err)
+		}
+		if bbDecompress.String() != data {
+			t.Fatalf("unexpected data decompressed for %+v", params)
+		}
+	}
+}
+
+// endlessReader repeats data and cancels the context after the given
+// number of reads.
+type endlessReader struct {
+	data   []byte
+	pos    int
+	reads  int
+	cancel func()
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	r.reads--
+	if r.reads == 0 {
+		r.cancel()
+	}
+	n := 0
+	for n < len(p) {
+		m := copy(p[n:], r.data[r.pos:])
+		n += m
+		r.pos = (r.pos + m) % len(r.data)
+	}
+	return n, nil
+}
+
+func TestStreamCompressContext(t *testing.T) {
+	data := newTestString(1024*1024, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &endlessReader{
+		data:   []byte(data),
+		reads:  10,
+		cancel: cancel,
+	}
+	if err := StreamCompressContext(ctx, ioutil.Discard, r); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error; got %v; want %v", err, context.Canceled)
+	}
+	if r.reads < -1 {
+		t.Fatalf("too many reads after the context cancelation: %d", -r.reads)
+	}
+
+	// The pooled writers must remain usable after the cancelation.
+	for i := 0; i < 10; i++ {
+		var bb bytes.Buffer
+		if err := StreamCompressContext(context.Background(), &bb, bytes.NewBufferString(data)); err != nil {
+			t.Fatalf("cannot compress stream: %s", err)
+		}
+		plainData, err := Decompress(nil, bb.Bytes())
+		if err != nil {
+			t.Fatalf("cannot decompress data: %s", err)
+		}
+		if string(plainData) != data {
+			t.Fatalf("unexpected data decompressed")
+		}
+	}
+}
+
+func TestStreamDecompressContext(t *testing.T) {
+	data := newTestString(1024*1024, 3)
+	cd := Compress(nil, []byte(data))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &endlessReader{
+		data:   cd,
+		reads:  10,
+		cancel: cancel,
+	}
+	if err := StreamDecompressContext(ctx, ioutil.Discard, r); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error; got %v; want %v", err, context.Canceled)
+	}
+	if r.reads < -1 {
+		t.Fatalf("too many reads after the context cancelation: %d", -r.reads)
+	}
+
+	// The pooled readers must remain usable after the cancelation.
+	for i := 0; i < 10; i++ {
+		var bb bytes.Buffer
+		if err := StreamDecompressContext(context.Background(), &bb, bytes.NewReader(cd)); err != nil {
+			t.Fatalf("cannot decompress stream: %s", err)
+		}
+		if bb.String() != data {
+			t.Fatalf("unexpected data decompressed")
+		}
+	}
+}
+
 func TestStreamCompressDecompressDict(t *testing.T) {
 	var samples [][]byte
 	for i := 0; i < 1000; i++ {
@@ -0,0 +1,100 @@
+package gozstd
+
+/*
+#cgo CFLAGS: -O3
+
+#define ZSTD_STATIC_LINKING_ONLY
+#include "zstd.h"
+#include "zstd_errors.h"
+
+#include <stdint.h>  // for uintptr_t
+
+// The following *_wrapper functions allow avoiding memory allocations
+// durting calls from Go.
+// See https://github.com/golang/go/issues/24450 .
+
+static size_t ZSTD_CCtx_refThreadPool_wrapper(uintptr_t cs, uintptr_t pool) {
+    return ZSTD_CCtx_refThreadPool((ZSTD_CCtx*)cs, (ZSTD_threadPool*)pool);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+)
+
+// ThreadPool is a pool of compression threads, which may be shared
+// among multiple Writers via WriterParams.ThreadPool.
+//
+// Sharing a single ThreadPool limits the number of compression threads
+// used by concurrently running Writers to the size of the pool.
+type ThreadPool struct {
+	p    *C.ZSTD_threadPool
+	size int
+}
+
+// NewThreadPool returns new ThreadPool with the given number of threads.
+//
+// Call Release when the pool is no longer needed.
+func NewThreadPool(size int) (*ThreadPool, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("thread pool size must be positive; got %d: %w", size, ErrParameterOutOfBound)
+	}
+	if err := checkCParameter("ThreadPool size", C.ZSTD_c_nbWorkers, size); err != nil {
+		return nil, err
+	}
+	p := C.ZSTD_createThreadPool(C.size_t(size))
+	if p == nil {
+		return nil, fmt.Errorf("cannot create thread pool with %d threads", size)
+	}
+	tp := &ThreadPool{
+		p:    p,
+		size: size,
+	}
+	runtime.SetFinalizer(tp, freeThreadPool)
+	return tp, nil
+}
+
+// Size returns the number of threads in tp.
+func (tp *ThreadPool) Size() int {
+	return tp.size
+}
+
+// Release stops the threads in tp after finishing all the queued jobs.
+//
+// tp cannot be used after the release. Release must be called only
+// after all the Writers using tp are released or reset to parameters
+// without tp.
+func (tp *ThreadPool) Release() {
+	if tp.p == nil {
+		return
+	}
+	C.ZSTD_freeThreadPool(tp.p)
+	tp.p = nil
+}
+
+func freeThreadPool(v interface{}) {
+	v.(*ThreadPool).Release()
+}
+
+// refThreadPool makes cs use the threads from tp.
+//
+// Pass nil tp for making cs use its own threads.
+func refThreadPool(cs *C.ZSTD_CStream, tp *ThreadPool) error {
+	var p *C.ZSTD_threadPool
+	if tp != nil {
+		if tp.p == nil {
+			return fmt.Errorf("cannot use released thread pool")
+		}
+		p = tp.p
+	}
+	result := C.ZSTD_CCtx_refThreadPool_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(cs))),
+		C.uintptr_t(uintptr(unsafe.Pointer(p))))
+	if err := newError(result); err != nil {
+		return fmt.Errorf("cannot set thread pool: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package gozstd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestNewThreadPoolInvalidSize(t *testing.T) {
+	for _, size := range []int{-1, 0, 1 << 20} {
+		tp, err := NewThreadPool(size)
+		if !errors.Is(err, ErrParameterOutOfBound) {
+			t.Fatalf("unexpected error for size=%d; got %v; want %v", size, err, ErrParameterOutOfBound)
+		}
+		if tp != nil {
+			t.Fatalf("expecting nil pool for size=%d", size)
+		}
+	}
+}
+
+func TestThreadPoolSize(t *testing.T) {
+	tp, err := NewThreadPool(3)
+	if err != nil {
+		t.Fatalf("cannot create thread pool: %s", err)
+	}
+	if n := tp.Size(); n != 3 {
+		t.Fatalf("unexpected pool size; got %d; want 3", n)
+	}
+	tp.Release()
+
+	// Repeated release must be no-op.
+	tp.Release()
+}
+
+func TestThreadPoolSharedWriters(t *testing.T) {
+	tp, err := NewThreadPool(2)
+	if err != nil {
+		t.Fatalf("cannot create thread pool: %s", err)
+	}
+	defer tp.Release()
+
+	src := []byte(newTestString(2*1024*1024, 10))
+	ch := make(chan error, 8)
+	for i := 0; i < cap(ch); i++ {
+		go func() {
+			ch <- testThreadPoolWriterSerial(tp, src)
+		}()
+	}
+	for i := 0; i < cap(ch); i++ {
+		if err := <-ch; err != nil {
+			t.Fatalf("error in concurrent test: %s", err)
+		}
+	}
+}
+
+func testThreadPoolWriterSerial(tp *ThreadPool, src []byte) error {
+	var bb bytes.Buffer
+	zw := NewWriterParams(&bb, &WriterParams{
+		ThreadPool: tp,
+		JobSize:    512 * 1024,
+	})
+	defer zw.Release()
+	if _, err := zw.Write(src); err != nil {
+		return fmt.Errorf("cannot write data: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("cannot close zw: %w", err)
+	}
+	plainData, err := Decompress(nil, bb.Bytes())
+	if err != nil {
+		return fmt.Errorf("cannot decompress data: %w", err)
+	}
+	if !bytes.Equal(plainData, src) {
+		return fmt.Errorf("unexpected data decompressed")
+	}
+	return nil
+}
+
+func TestThreadPoolWriterReset(t *testing.T) {
+	tp1, err := NewThreadPool(2)
+	if err != nil {
+		t.Fatalf("cannot create thread pool: %s", err)
+	}
+	tp2, err := NewThreadPool(3)
+	if err != nil {
+		t.Fatalf("cannot create thread pool: %s", err)
+	}
+	defer tp2.Release()
+
+	src := []byte(newTestString(2*1024*1024, 10))
+	zw := NewWriterParams(nil, &WriterParams{ThreadPool: tp1})
+	defer zw.Release()
+	paramsList := []*WriterParams{
+		{ThreadPool: tp1},
+		{ThreadPool: tp2},
+		{Workers: 2},
+		{},
+		{ThreadPool: tp2},
+	}
+	for i, params := range paramsList {
+		if i == 2 {
+			// The writer must stop using tp1 after switching to tp2.
+			tp1.Release()
+		}
+		var bb bytes.Buffer
+		zw.ResetWriterParams(&bb, params)
+		if _, err := zw.Write(src); err != nil {
+			t.Fatalf("cannot write data with %+v: %s", params, err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("cannot close zw with %+v: %s", params, err)
+		}
+		plainData, err := Decompress(nil, bb.Bytes())
+		if err != nil {
+			t.Fatalf("cannot decompress data written with %+v: %s", params, err)
+		}
+		if !bytes.Equal(plainData, src) {
+			t.Fatalf("unexpected data decompressed for %+v", params)
+		}
+	}
+}
+
+func TestThreadPoolReleased(t *testing.T) {
+	tp, err := NewThreadPool(1)
+	if err != nil {
+		t.Fatalf("cannot create thread pool: %s", err)
+	}
+	tp.Release()
+
+	zw := NewWriterParams(ioutil.Discard, &WriterParams{ThreadPool: tp})
+	defer zw.Release()
+	if _, err := zw.Write([]byte("foobar")); err == nil {
+		t.Fatalf("expecting non-nil error when using released thread pool")
+	}
+}
@@ -7,6 +7,9 @@ package gozstd
 #include "zstd.h"
 #include "zstd_errors.h"
 
+#define XXH_STATIC_LINKING_ONLY
+#include "xxhash.h"
+
 #include <stdlib.h>  // for malloc/free
 #include <stdint.h>  // for uintptr_t
 
@@ -18,8 +21,12 @@ static size_t ZSTD_CCtx_setParameter_wrapper(uintptr_t cs, ZSTD_cParameter param
     return ZSTD_CCtx_setParameter((ZSTD_CStream*)cs, param, value);
 }
 
-static size_t ZSTD_initCStream_wrapper(uintptr_t cs, int compressionLevel) {
-    return ZSTD_initCStream((ZSTD_CStream*)cs, compressionLevel);
+static size_t ZSTD_CCtx_reset_wrapper(uintptr_t cs, ZSTD_ResetDirective reset) {
+    return ZSTD_CCtx_reset((ZSTD_CStream*)cs, reset);
+}
+
+static size_t ZSTD_CCtx_setPledgedSrcSize_wrapper(uintptr_t cs, unsigned long long pledgedSrcSize) {
+    return ZSTD_CCtx_setPledgedSrcSize((ZSTD_CStream*)cs, pledgedSrcSize);
 }
 
 static size_t ZSTD_CCtx_refCDict_wrapper(uintptr_t cc, uintptr_t dict) {
@@ -30,8 +37,27 @@ static size_t ZSTD_freeCStream_wrapper(uintptr_t cs) {
     return ZSTD_freeCStream((ZSTD_CStream*)cs);
 }
 
-static size_t ZSTD_compressStream_wrapper(uintptr_t cs, uintptr_t output, uintptr_t input) {
-    return ZSTD_compressStream((ZSTD_CStream*)cs, (ZSTD_outBuffer*)output, (ZSTD_inBuffer*)input);
+static size_t ZSTD_compressStream_wrapper(uintptr_t cs, uintptr_t output, uintptr_t input, uintptr_t xxhState) {
+    ZSTD_inBuffer* in = (ZSTD_inBuffer*)input;
+    size_t prevPos = in->pos;
+    size_t result = ZSTD_compressStream((ZSTD_CStream*)cs, (ZSTD_outBuffer*)output, in);
+    if (xxhState != 0 && !ZSTD_isError(result)) {
+        // Hash the data consumed by the compressor.
+        XXH64_update((XXH64_state_t*)xxhState, (const char*)in->src + prevPos, in->pos - prevPos);
+    }
+    return result;
+}
+
+static size_t ZSTD_compressStream_simpleArgs_wrapper(uintptr_t cs, uintptr_t output, uintptr_t src, size_t srcSize, uintptr_t srcPos, uintptr_t xxhState) {
+    ZSTD_outBuffer* out = (ZSTD_outBuffer*)output;
+    size_t prevPos = *(size_t*)srcPos;
+    size_t result = ZSTD_compressStream2_simpleArgs((ZSTD_CCtx*)cs, out->dst, out->size, &out->pos,
+        (const void*)src, srcSize, (size_t*)srcPos, ZSTD_e_continue);
+    if (xxhState != 0 && !ZSTD_isError(result)) {
+        // Hash the data consumed by the compressor.
+        XXH64_update((XXH64_state_t*)xxhState, (const char*)src + prevPos, *(size_t*)srcPos - prevPos);
+    }
+    return result;
 }
 
 static size_t ZSTD_flushStream_wrapper(uintptr_t cs, uintptr_t output) {
@@ -42,10 +68,27 @@ static size_t ZSTD_endStream_wrapper(uintptr_t cs, uintptr_t output) {
     return ZSTD_endStream((ZSTD_CStream*)cs, (ZSTD_outBuffer*)output);
 }
 
+static uintptr_t XXH64_createState_wrapper() {
+    return (uintptr_t)XXH64_createState();
+}
+
+static void XXH64_freeState_wrapper(uintptr_t state) {
+    XXH64_freeState((XXH64_state_t*)state);
+}
+
+static void XXH64_reset_wrapper(uintptr_t state) {
+    XXH64_reset((XXH64_state_t*)state, 0);
+}
+
+static unsigned long long XXH64_digest_wrapper(uintptr_t state) {
+    return XXH64_digest((const XXH64_state_t*)state);
+}
+
 */
 import "C"
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"runtime"
@@ -60,18 +103,41 @@ var (
 type cMemPtr *[1 << 30]byte
 
 // Writer implements zstd writer.
+//
+// If an error occurs while writing to a Writer, no more data will be accepted
+// and all the subsequent calls to Write, ReadFrom, Flush and Close will return
+// the error. Reset or ResetWriterParams clears the error.
 type Writer struct {
-	w                io.Writer
-	compressionLevel int
-	wlog             int
-	cs               *C.ZSTD_CStream
-	cd               *CDict
+	w      io.Writer
+	params WriterParams
+	cs     *C.ZSTD_CStream
 
 	inBuf  *C.ZSTD_inBuffer
 	outBuf *C.ZSTD_outBuffer
 
 	inBufGo  cMemPtr
 	outBufGo cMemPtr
+
+	// xxhState is the state for hashing all the data written since
+	// the last reset. It is allocated when WriterParams.Checksum is set.
+	xxhState C.uintptr_t
+
+	// contentChecksum is the hash of the data written until the end
+	// of the last finished frame. It is valid if hasContentChecksum is set.
+	contentChecksum    uint64
+	hasContentChecksum bool
+
+	// frameWritten is the size of uncompressed data written
+	// to the current frame.
+	frameWritten int64
+
+	// frameEndedAuto is set if the last frame was finished
+	// because of WriterParams.FrameSize.
+	frameEndedAuto bool
+
+	// err is the first error occurred in zw.
+	// It is returned from all the subsequent calls until zw is reset.
+	err error
 }
 
 // NewWriter returns new zstd writer writing compressed data to w.
@@ -119,11 +185,44 @@ const (
 	WindowLogMax32 = 30 // from zstd.h
 	// WindowLogMax64 is the maximum value of the windowLog parameter on 64-bit architectures.
 	WindowLogMax64 = 31 // from zstd.h
+	// WindowLogMax is the maximum value of the windowLog parameter on the current architecture.
+	WindowLogMax = WindowLogMax32 + (WindowLogMax64-WindowLogMax32)*int(^uint(0)>>63)
 
 	// DefaultWindowLog is the default value of the windowLog parameter.
 	DefaultWindowLog = 0
 )
 
+// Strategy is compression strategy. Strategies are listed from the fastest
+// to the strongest.
+type Strategy int
+
+const (
+	// StrategyDefault means 'use default strategy for the compression level'.
+	StrategyDefault Strategy = 0
+
+	StrategyFast     Strategy = 1 // from zstd.h
+	StrategyDFast    Strategy = 2 // from zstd.h
+	StrategyGreedy   Strategy = 3 // from zstd.h
+	StrategyLazy     Strategy = 4 // from zstd.h
+	StrategyLazy2    Strategy = 5 // from zstd.h
+	StrategyBtLazy2  Strategy = 6 // from zstd.h
+	StrategyBtOpt    Strategy = 7 // from zstd.h
+	StrategyBtUltra  Strategy = 8 // from zstd.h
+	StrategyBtUltra2 Strategy = 9 // from zstd.h
+)
+
+// ParamSwitch enables or disables a compression feature,
+// which may be also enabled automatically by zstd.
+type ParamSwitch int
+
+const (
+	// ParamSwitchAuto lets zstd decide whether to enable the feature.
+	ParamSwitchAuto ParamSwitch = 0 // ZSTD_ps_auto from zstd.h
+
+	ParamSwitchEnable  ParamSwitch = 1 // ZSTD_ps_enable from zstd.h
+	ParamSwitchDisable ParamSwitch = 2 // ZSTD_ps_disable from zstd.h
+)
+
 // A WriterParams allows users to specify compression parameters by calling
 // NewWriterParams.
 //
@@ -133,16 +232,128 @@ type WriterParams struct {
 	// Compression level. Special value 0 means 'default compression level'.
 	CompressionLevel int
 
-	// WindowLog. Must be clamped between WindowLogMin and WindowLogMin32/64.
+	// WindowLog. Must be clamped between WindowLogMin and WindowLogMax.
 	// Special value 0 means 'use default windowLog'.
 	//
-	// Note: enabling log distance matching increases memory usage for both
-	// compressor and decompressor. When set to a value greater than 27, the
-	// decompressor requires special treatment.
+	// Note: big windowLog increases memory usage for both compressor
+	// and decompressor. Frames with windowLog greater than 27 are rejected
+	// by the decompressor by default, so ReaderParams.MaxWindowLog
+	// or DecompressOptions.MaxWindowLog must be set to at least WindowLog
+	// for reading them.
 	WindowLog int
 
 	// Dict is optional dictionary used for compression.
 	Dict *CDict
+
+	// The following parameters tune the compression level.
+	// Special value 0 means 'use the value from the compression level'.
+	// See the corresponding ZSTD_c_* parameters in zstd.h for details.
+
+	// Strategy is compression strategy.
+	Strategy Strategy
+
+	// HashLog is the size of the initial probe table, as a power of 2.
+	HashLog int
+
+	// ChainLog is the size of the multi-probe search table, as a power of 2.
+	ChainLog int
+
+	// SearchLog is the number of search attempts, as a power of 2.
+	SearchLog int
+
+	// MinMatch is the minimum size of searched matches.
+	MinMatch int
+
+	// TargetLength has strategy-dependent meaning. Larger values usually
+	// improve compression ratio at the cost of compression speed.
+	TargetLength int
+
+	// TargetCBlockSize is the size of compressed blocks the compressor tries
+	// to produce. It improves latency for the decompressor at the cost
+	// of compression ratio. Special value 0 disables the feature.
+	TargetCBlockSize int
+
+	// LongDistanceMatching controls long distance matching, which finds
+	// matches at distances up to the window size. It is useful for big
+	// inputs with redundancy far apart, when combined with big WindowLog.
+	//
+	// With ParamSwitchAuto, long distance matching is enabled automatically
+	// for strategies starting from StrategyBtOpt when WindowLog is at least 27.
+	// Set it to ParamSwitchDisable for disabling it in this case.
+	LongDistanceMatching ParamSwitch
+
+	// The following parameters tune long distance matching.
+	// Special value 0 means 'use the default value'.
+	// See the corresponding ZSTD_c_ldm* parameters in zstd.h for details.
+
+	// LdmHashLog is the size of the table for long distance matching,
+	// as a power of 2.
+	LdmHashLog int
+
+	// LdmMinMatch is the minimum size of matches searched by long distance
+	// matching.
+	LdmMinMatch int
+
+	// LdmBucketSizeLog is the size of buckets in the long distance matching
+	// table, as a power of 2.
+	LdmBucketSizeLog int
+
+	// LdmHashRateLog is the frequency of inserting entries into the long
+	// distance matching table, as a power of 2.
+	LdmHashRateLog int
+
+	// NoContentSize disables writing content size into frame headers.
+	NoContentSize bool
+
+	// NoDictID disables writing dictionary ID into frame headers.
+	NoDictID bool
+
+	// Workers is the number of threads used for compression.
+	// Special value 0 means 'compress in the calling goroutine'.
+	//
+	// When Workers is set, the data passed to Write is compressed
+	// asynchronously in background threads, so Write returns faster,
+	// while Flush and Close wait until the compression is finished.
+	Workers int
+
+	// JobSize is the size of data in bytes compressed by a single worker.
+	// It is used only when Workers is set.
+	// Special value 0 means 'use automatic job size'.
+	JobSize int
+
+	// OverlapLog is the size of data reloaded from the previous job
+	// as a fraction of the window size. It is used only when Workers is set.
+	// 1 means 'no overlap', 9 means 'full window'.
+	// Special value 0 means 'use the value from the compression level'.
+	OverlapLog int
+
+	// FrameSize is the size of uncompressed data in bytes, after which
+	// the frame is finished automatically like with Writer.EndFrame.
+	// The next frame is started when more data is written.
+	// Special value 0 means 'finish frames only on EndFrame or Close'.
+	FrameSize int
+
+	// Checksum enables writing content checksum at the end of frames.
+	// The checksum is verified by Reader and Decompress.
+	//
+	// The XXH64 hash of all the data written since the last reset
+	// is available via Writer.ContentChecksum after Close or EndFrame.
+	Checksum bool
+
+	// ThreadPool is the pool of threads shared with other Writers.
+	//
+	// When ThreadPool is set, the data is compressed in the threads
+	// from the pool and Workers is ignored - ThreadPool.Size is used instead.
+	ThreadPool *ThreadPool
+
+	// Context is optional context for canceling the compression.
+	//
+	// The context is checked between compressed chunks. Write, ReadFrom,
+	// Flush and Close return Context.Err() after the context is done.
+	// Reset drops the context and makes the Writer usable again.
+	// ResetWriterParams makes the Writer usable again if the new context
+	// isn't done.
+	Context context.Context
 }
 
 // NewWriterParams returns new zstd writer writing compressed data to w
@@ -151,6 +362,9 @@ type WriterParams struct {
 // The returned writer must be closed with Close call in order
 // to finalize the compressed stream.
 //
+// Invalid params result in error returned from the first Write, ReadFrom,
+// Flush or Close call.
+//
 // Call Release when the Writer is no longer needed.
 func NewWriterParams(w io.Writer, params *WriterParams) *Writer {
 	if params == nil {
@@ -158,7 +372,6 @@ func NewWriterParams(w io.Writer, params *WriterParams) *Writer {
 	}
 
 	cs := C.ZSTD_createCStream()
-	initCStream(cs, *params)
 
 	inBuf := (*C.ZSTD_inBuffer)(C.calloc(1, C.sizeof_ZSTD_inBuffer))
 	inBuf.src = C.calloc(1, cstreamInBufSize)
@@ -171,17 +384,17 @@ func NewWriterParams(w io.Writer, params *WriterParams) *Writer {
 	outBuf.pos = 0
 
 	zw := &Writer{
-		w:                w,
-		compressionLevel: params.CompressionLevel,
-		wlog:             params.WindowLog,
-		cs:               cs,
-		cd:               params.Dict,
-		inBuf:            inBuf,
-		outBuf:           outBuf,
+		w:      w,
+		params: *params,
+		cs:     cs,
+		inBuf:  inBuf,
+		outBuf: outBuf,
 	}
 
 	zw.inBufGo = cMemPtr(zw.inBuf.src)
 	zw.outBufGo = cMemPtr(zw.outBuf.dst)
+	zw.err = initCStream(cs, *params)
+	zw.resetContentChecksum()
 
 	runtime.SetFinalizer(zw, freeCStream)
 	return zw
@@ -190,46 +403,157 @@ func NewWriterParams(w io.Writer, params *WriterParams) *Writer {
 // Reset resets zw to write to w using the given dictionary cd and the given
 // compressionLevel. Use ResetWriterParams if you wish to change other
 // parameters that were set via WriterParams.
+//
+// Reset drops WriterParams.Context.
 func (zw *Writer) Reset(w io.Writer, cd *CDict, compressionLevel int) {
-	params := WriterParams{
-		CompressionLevel: compressionLevel,
-		WindowLog:        zw.wlog,
-		Dict:             cd,
-	}
+	params := zw.params
+	params.CompressionLevel = compressionLevel
+	params.Dict = cd
+	params.Context = nil
 	zw.ResetWriterParams(w, &params)
 }
 
 // ResetWriterParams resets zw to write to w using the given set of parameters.
+//
+// It also clears the error occurred in zw, if any.
 func (zw *Writer) ResetWriterParams(w io.Writer, params *WriterParams) {
 	zw.inBuf.size = 0
 	zw.inBuf.pos = 0
 	zw.outBuf.size = cstreamOutBufSize
 	zw.outBuf.pos = 0
 
-	zw.cd = params.Dict
-	initCStream(zw.cs, *params)
+	if params.ThreadPool != zw.params.ThreadPool {
+		// The stream keeps the threads it used for the previous compression
+		// until it is freed, so re-create it for switching to other threads.
+		result := C.ZSTD_freeCStream_wrapper(
+			C.uintptr_t(uintptr(unsafe.Pointer(zw.cs))))
+		ensureNoError("ZSTD_freeCStream", result)
+		zw.cs = C.ZSTD_createCStream()
+	}
+
+	zw.params = *params
+	zw.err = initCStream(zw.cs, *params)
+	zw.resetContentChecksum()
+	zw.frameWritten = 0
+	zw.frameEndedAuto = false
 
 	zw.w = w
 }
 
-func initCStream(cs *C.ZSTD_CStream, params WriterParams) {
+func initCStream(cs *C.ZSTD_CStream, params WriterParams) error {
+	// Reset all the parameters set previously and drop the frame left
+	// unfinished after the previous error, if any.
+	result := C.ZSTD_CCtx_reset_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(cs))),
+		C.ZSTD_reset_session_and_parameters)
+	if err := newError(result); err != nil {
+		return fmt.Errorf("cannot reset compression stream: %w", err)
+	}
+
+	if params.ThreadPool != nil {
+		if err := refThreadPool(cs, params.ThreadPool); err != nil {
+			return err
+		}
+		// Use all the threads from the pool, since zstd resizes the pool
+		// to the number of workers.
+		params.Workers = params.ThreadPool.Size()
+	}
+
 	if params.Dict != nil {
 		result := C.ZSTD_CCtx_refCDict_wrapper(
 			C.uintptr_t(uintptr(unsafe.Pointer(cs))),
 			C.uintptr_t(uintptr(unsafe.Pointer(params.Dict.p))))
-		ensureNoError("ZSTD_CCtx_refCDict", result)
-	} else {
-		result := C.ZSTD_initCStream_wrapper(
-			C.uintptr_t(uintptr(unsafe.Pointer(cs))),
-			C.int(params.CompressionLevel))
-		ensureNoError("ZSTD_initCStream", result)
+		if err := newError(result); err != nil {
+			return fmt.Errorf("cannot set dictionary: %w", err)
+		}
+	} else if err := setCParameter(cs, "CompressionLevel", C.ZSTD_c_compressionLevel, params.CompressionLevel); err != nil {
+		return err
 	}
 
+	cParams := []struct {
+		name  string
+		param C.ZSTD_cParameter
+		value int
+	}{
+		{"WindowLog", C.ZSTD_c_windowLog, params.WindowLog},
+		{"Strategy", C.ZSTD_c_strategy, int(params.Strategy)},
+		{"HashLog", C.ZSTD_c_hashLog, params.HashLog},
+		{"ChainLog", C.ZSTD_c_chainLog, params.ChainLog},
+		{"SearchLog", C.ZSTD_c_searchLog, params.SearchLog},
+		{"MinMatch", C.ZSTD_c_minMatch, params.MinMatch},
+		{"TargetLength", C.ZSTD_c_targetLength, params.TargetLength},
+		{"TargetCBlockSize", C.ZSTD_c_targetCBlockSize, params.TargetCBlockSize},
+		{"Workers", C.ZSTD_c_nbWorkers, params.Workers},
+		{"JobSize", C.ZSTD_c_jobSize, params.JobSize},
+		{"OverlapLog", C.ZSTD_c_overlapLog, params.OverlapLog},
+		{"LongDistanceMatching", C.ZSTD_c_enableLongDistanceMatching, int(params.LongDistanceMatching)},
+		{"LdmHashLog", C.ZSTD_c_ldmHashLog, params.LdmHashLog},
+		{"LdmMinMatch", C.ZSTD_c_ldmMinMatch, params.LdmMinMatch},
+		{"LdmBucketSizeLog", C.ZSTD_c_ldmBucketSizeLog, params.LdmBucketSizeLog},
+		{"LdmHashRateLog", C.ZSTD_c_ldmHashRateLog, params.LdmHashRateLog},
+	}
+	for _, cp := range cParams {
+		if cp.value == 0 {
+			// The default value has been already set by the reset above.
+			continue
+		}
+		if err := setCParameter(cs, cp.name, cp.param, cp.value); err != nil {
+			return err
+		}
+	}
+	if params.FrameSize < 0 {
+		return fmt.Errorf("FrameSize cannot be negative; got %d", params.FrameSize)
+	}
+	if params.Checksum {
+		if err := setCParameter(cs, "Checksum", C.ZSTD_c_checksumFlag, 1); err != nil {
+			return err
+		}
+	}
+	if params.NoContentSize {
+		if err := setCParameter(cs, "NoContentSize", C.ZSTD_c_contentSizeFlag, 0); err != nil {
+			return err
+		}
+	}
+	if params.NoDictID {
+		if err := setCParameter(cs, "NoDictID", C.ZSTD_c_dictIDFlag, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setCParameter sets the given compression parameter in cs.
+func setCParameter(cs *C.ZSTD_CStream, name string, param C.ZSTD_cParameter, value int) error {
+	if err := checkCParameter(name, param, value); err != nil {
+		return err
+	}
 	result := C.ZSTD_CCtx_setParameter_wrapper(
 		C.uintptr_t(uintptr(unsafe.Pointer(cs))),
-		C.ZSTD_cParameter(C.ZSTD_c_windowLog),
-		C.int(params.WindowLog))
-	ensureNoError("ZSTD_CCtx_setParameter", result)
+		param,
+		C.int(value))
+	if err := newError(result); err != nil {
+		return fmt.Errorf("cannot set %s=%d: %w", name, value, err)
+	}
+	return nil
+}
+
+// checkCParameter verifies whether the given value is in the bounds
+// for the given compression parameter.
+//
+// Compression level isn't verified, since zstd clamps it to the valid range.
+func checkCParameter(name string, param C.ZSTD_cParameter, value int) error {
+	if param == C.ZSTD_c_compressionLevel {
+		return nil
+	}
+	bounds := C.ZSTD_cParam_getBounds(param)
+	if err := newError(bounds.error); err != nil {
+		return fmt.Errorf("cannot obtain bounds for %s: %w", name, err)
+	}
+	if value < int(bounds.lowerBound) || value > int(bounds.upperBound) {
+		return fmt.Errorf("%s=%d is out of bounds [%d..%d]: %w",
+			name, value, bounds.lowerBound, bounds.upperBound, ErrParameterOutOfBound)
+	}
+	return nil
 }
 
 func freeCStream(v interface{}) {
@@ -257,8 +581,45 @@ func (zw *Writer) Release() {
 	C.free(unsafe.Pointer(zw.outBuf))
 	zw.outBuf = nil
 
+	if zw.xxhState != 0 {
+		C.XXH64_freeState_wrapper(zw.xxhState)
+		zw.xxhState = 0
+	}
+	zw.hasContentChecksum = false
+
 	zw.w = nil
-	zw.cd = nil
+	zw.params = WriterParams{}
+	zw.err = nil
+}
+
+// SetPledgedSize sets the size of uncompressed data for the next frame
+// written to zw.
+//
+// The size is stored in the frame header, so Decompress may allocate memory
+// for the decompressed frame at once. SetPledgedSize must be called before
+// writing data to the frame, i.e. after creating zw, Reset or Close.
+// The pledged size applies only to a single frame.
+//
+// Write or Close returns an error wrapping ErrSrcSizeWrong if the size
+// of the data written to the frame doesn't match the pledged size.
+func (zw *Writer) SetPledgedSize(size int64) error {
+	if zw.err != nil {
+		return zw.err
+	}
+	if size < 0 {
+		return fmt.Errorf("pledged size cannot be negative; got %d", size)
+	}
+	if zw.frameWritten > 0 {
+		// The data may be already passed to zstd, so inBuf may be empty.
+		return fmt.Errorf("cannot set pledged size %d after writing data to the frame", size)
+	}
+	result := C.ZSTD_CCtx_setPledgedSrcSize_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(zw.cs))),
+		C.ulonglong(size))
+	if err := newError(result); err != nil {
+		return fmt.Errorf("cannot set pledged size %d: %w", size, err)
+	}
+	return nil
 }
 
 // ReadFrom reads all the data from r and writes it to zw.
@@ -270,15 +631,21 @@ func (zw *Writer) Release() {
 // Call Flush or Close when the compressed data must propagate
 // to the underlying writer.
 func (zw *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if zw.err != nil {
+		return 0, zw.err
+	}
+
 	nn := int64(0)
 	for {
 		// Fill the inBuf.
-		for zw.inBuf.size < cstreamInBufSize {
-			n, err := r.Read(zw.inBufGo[zw.inBuf.size:cstreamInBufSize])
+		inBufEnd := zw.inBufEnd()
+		for zw.inBuf.size < inBufEnd {
+			n, err := r.Read(zw.inBufGo[zw.inBuf.size:inBufEnd])
 
 			// Sometimes n > 0 even when Read() returns an error.
 			// This is true especially if the error is io.EOF.
 			zw.inBuf.size += C.size_t(n)
+			zw.frameWritten += int64(n)
 			nn += int64(n)
 
 			if err != nil {
@@ -288,6 +655,12 @@ func (zw *Writer) ReadFrom(r io.Reader) (int64, error) {
 				return nn, err
 			}
 		}
+		if zw.isFrameFull() {
+			if err := zw.endFullFrame(); err != nil {
+				return nn, err
+			}
+			continue
+		}
 
 		// Flush the inBuf.
 		if err := zw.flushInBuf(); err != nil {
@@ -303,32 +676,165 @@ func (zw *Writer) ReadFrom(r io.Reader) (int64, error) {
 // Call Flush or Close when the compressed data must propagate
 // to the underlying writer.
 func (zw *Writer) Write(p []byte) (int, error) {
+	if zw.err != nil {
+		return 0, zw.err
+	}
 	pLen := len(p)
 	if pLen == 0 {
 		return 0, nil
 	}
+	if pLen >= int(cstreamInBufSize) {
+		// Fast path - pass p directly to zstd without copying it to inBuf.
+		if err := zw.writeDirect(p); err != nil {
+			return 0, err
+		}
+		return pLen, nil
+	}
 
 	for {
-		n := copy(zw.inBufGo[zw.inBuf.size:cstreamInBufSize], p)
+		n := copy(zw.inBufGo[zw.inBuf.size:zw.inBufEnd()], p)
 		zw.inBuf.size += C.size_t(n)
+		zw.frameWritten += int64(n)
 		p = p[n:]
+		if zw.isFrameFull() {
+			if err := zw.endFullFrame(); err != nil {
+				return 0, err
+			}
+		}
 		if len(p) == 0 {
 			// Fast path - just copy the data to input buffer.
 			return pLen, nil
 		}
+		if zw.inBuf.size == 0 {
+			// The inBuf has been flushed when finishing the frame.
+			continue
+		}
 		if err := zw.flushInBuf(); err != nil {
 			return 0, err
 		}
 	}
 }
 
+func (zw *Writer) writeDirect(p []byte) error {
+	// Compress the data buffered in inBuf before p.
+	for zw.inBuf.size > 0 {
+		if err := zw.flushInBuf(); err != nil {
+			return err
+		}
+	}
+
+	for len(p) > 0 {
+		chunk := p
+		if zw.params.FrameSize > 0 {
+			if n := int64(zw.params.FrameSize) - zw.frameWritten; int64(len(chunk)) > n {
+				chunk = chunk[:n]
+			}
+		}
+		if err := zw.compressDirect(chunk); err != nil {
+			return err
+		}
+		zw.frameWritten += int64(len(chunk))
+		p = p[len(chunk):]
+		if zw.isFrameFull() {
+			if err := zw.endFullFrame(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compressDirect compresses src without copying it to inBuf.
+//
+// inBuf must be empty.
+func (zw *Writer) compressDirect(src []byte) error {
+	var xxhState C.uintptr_t
+	if zw.params.Checksum {
+		xxhState = zw.xxhState
+	}
+
+	// inBuf is empty, so its pos may hold the position in src.
+	for zw.inBuf.pos < C.size_t(len(src)) {
+		if err := zw.checkContext(); err != nil {
+			zw.inBuf.pos = 0
+			return err
+		}
+
+		prevSrcPos := zw.inBuf.pos
+		result := C.ZSTD_compressStream_simpleArgs_wrapper(
+			C.uintptr_t(uintptr(unsafe.Pointer(zw.cs))),
+			C.uintptr_t(uintptr(unsafe.Pointer(zw.outBuf))),
+			C.uintptr_t(uintptr(unsafe.Pointer(&src[0]))),
+			C.size_t(len(src)),
+			C.uintptr_t(uintptr(unsafe.Pointer(&zw.inBuf.pos))),
+			xxhState)
+		// Prevent from GC'ing of src during CGO call above.
+		runtime.KeepAlive(src)
+		if err := newError(result); err != nil {
+			zw.inBuf.pos = 0
+			zw.err = fmt.Errorf("cannot compress data: %w", err)
+			return zw.err
+		}
+
+		if zw.outBuf.size-zw.outBuf.pos > zw.outBuf.pos && prevSrcPos != zw.inBuf.pos {
+			// There is enough space in outBuf and the last compression
+			// succeeded, so don't flush outBuf yet.
+			continue
+		}
+		if err := zw.flushOutBuf(); err != nil {
+			zw.inBuf.pos = 0
+			return err
+		}
+	}
+	zw.inBuf.pos = 0
+	return nil
+}
+
+// endFullFrame finishes the current frame, which reached WriterParams.FrameSize.
+func (zw *Writer) endFullFrame() error {
+	if err := zw.EndFrame(); err != nil {
+		return err
+	}
+	zw.frameEndedAuto = true
+	return nil
+}
+
+func (zw *Writer) isFrameFull() bool {
+	return zw.params.FrameSize > 0 && zw.frameWritten >= int64(zw.params.FrameSize)
+}
+
+// inBufEnd returns the end of inBuf for the data, which doesn't cross
+// the frame boundary set by WriterParams.FrameSize.
+func (zw *Writer) inBufEnd() C.size_t {
+	if zw.params.FrameSize <= 0 {
+		return cstreamInBufSize
+	}
+	n := zw.inBuf.size + C.size_t(int64(zw.params.FrameSize)-zw.frameWritten)
+	if n > cstreamInBufSize {
+		return cstreamInBufSize
+	}
+	return n
+}
+
 func (zw *Writer) flushInBuf() error {
+	if err := zw.checkContext(); err != nil {
+		return err
+	}
+
 	prevInBufPos := zw.inBuf.pos
+	var xxhState C.uintptr_t
+	if zw.params.Checksum {
+		xxhState = zw.xxhState
+	}
 	result := C.ZSTD_compressStream_wrapper(
 		C.uintptr_t(uintptr(unsafe.Pointer(zw.cs))),
 		C.uintptr_t(uintptr(unsafe.Pointer(zw.outBuf))),
-		C.uintptr_t(uintptr(unsafe.Pointer(zw.inBuf))))
-	ensureNoError("ZSTD_compressStream", result)
+		C.uintptr_t(uintptr(unsafe.Pointer(zw.inBuf))),
+		xxhState)
+	if err := newError(result); err != nil {
+		zw.err = fmt.Errorf("cannot compress data: %w", err)
+		return zw.err
+	}
 
 	// Move the remaining data to the start of inBuf.
 	copy(zw.inBufGo[:cstreamInBufSize], zw.inBufGo[zw.inBuf.pos:zw.inBuf.size])
@@ -351,22 +857,46 @@ func (zw *Writer) flushOutBuf() error {
 		// Nothing to flush.
 		return nil
 	}
+	if err := zw.checkContext(); err != nil {
+		return err
+	}
 
 	outBuf := zw.outBufGo[:zw.outBuf.pos]
 	n, err := zw.w.Write(outBuf)
 	zw.outBuf.pos = 0
+	if err == nil && n != len(outBuf) {
+		// The underlying writer violated io.Writer contract and didn't return error
+		// after writing incomplete data.
+		err = io.ErrShortWrite
+	}
 	if err != nil {
-		return fmt.Errorf("cannot flush internal buffer to the underlying writer: %s", err)
+		zw.err = fmt.Errorf("cannot flush internal buffer to the underlying writer: %w", err)
+		return zw.err
+	}
+	return nil
+}
+
+// checkContext returns the error for the done WriterParams.Context.
+//
+// The error is sticky, since the current frame is left unfinished.
+func (zw *Writer) checkContext() error {
+	ctx := zw.params.Context
+	if ctx == nil {
+		return nil
 	}
-	if n != len(outBuf) {
-		panic(fmt.Errorf("BUG: the underlying writer violated io.Writer contract and didn't return error after writing incomplete data; written %d bytes; want %d bytes",
-			n, len(outBuf)))
+	if err := ctx.Err(); err != nil {
+		zw.err = err
+		return err
 	}
 	return nil
 }
 
 // Flush flushes the remaining data from zw to the underlying writer.
 func (zw *Writer) Flush() error {
+	if zw.err != nil {
+		return zw.err
+	}
+
 	// Flush inBuf.
 	for zw.inBuf.size > 0 {
 		if err := zw.flushInBuf(); err != nil {
@@ -379,7 +909,10 @@ func (zw *Writer) Flush() error {
 		result := C.ZSTD_flushStream_wrapper(
 			C.uintptr_t(uintptr(unsafe.Pointer(zw.cs))),
 			C.uintptr_t(uintptr(unsafe.Pointer(zw.outBuf))))
-		ensureNoError("ZSTD_flushStream", result)
+		if err := newError(result); err != nil {
+			zw.err = fmt.Errorf("cannot flush compressed data: %w", err)
+			return zw.err
+		}
 		if err := zw.flushOutBuf(); err != nil {
 			return err
 		}
@@ -395,6 +928,22 @@ func (zw *Writer) Flush() error {
 //
 // It doesn't close the underlying writer passed to New* functions.
 func (zw *Writer) Close() error {
+	if zw.frameEndedAuto && zw.frameWritten == 0 && zw.err == nil {
+		// The last frame has been already finished because of
+		// WriterParams.FrameSize, so do not write an empty frame.
+		return nil
+	}
+	return zw.EndFrame()
+}
+
+// EndFrame finishes the current frame and flushes all the compressed data
+// to the underlying writer.
+//
+// The data written after EndFrame goes to the next frame, which is compressed
+// with the same parameters. This allows writing a stream of independently
+// decodable frames with a single Writer.
+func (zw *Writer) EndFrame() error {
+	zw.frameEndedAuto = false
 	if err := zw.Flush(); err != nil {
 		return err
 	}
@@ -403,12 +952,47 @@ func (zw *Writer) Close() error {
 		result := C.ZSTD_endStream_wrapper(
 			C.uintptr_t(uintptr(unsafe.Pointer(zw.cs))),
 			C.uintptr_t(uintptr(unsafe.Pointer(zw.outBuf))))
-		ensureNoError("ZSTD_endStream", result)
+		if err := newError(result); err != nil {
+			zw.err = fmt.Errorf("cannot finalize compressed stream: %w", err)
+			return zw.err
+		}
 		if err := zw.flushOutBuf(); err != nil {
 			return err
 		}
 		if result == 0 {
+			zw.frameWritten = 0
+			if zw.params.Checksum {
+				// Do not reset the hash, so it covers all the frames.
+				zw.contentChecksum = uint64(C.XXH64_digest_wrapper(zw.xxhState))
+				zw.hasContentChecksum = true
+			}
 			return nil
 		}
 	}
 }
+
+// ContentChecksum returns XXH64 hash of all the uncompressed data written
+// since the last reset until the last EndFrame or Close call.
+//
+// Every frame ends with the lower 32 bits of the hash of its own data,
+// so they match the returned hash only for the first frame.
+// false is returned if WriterParams.Checksum isn't set or no frames
+// were finished since the last reset.
+func (zw *Writer) ContentChecksum() (uint64, bool) {
+	return zw.contentChecksum, zw.hasContentChecksum
+}
+
+func (zw *Writer) resetContentChecksum() {
+	zw.contentChecksum = 0
+	zw.hasContentChecksum = false
+	if !zw.params.Checksum {
+		return
+	}
+	if zw.xxhState == 0 {
+		zw.xxhState = C.XXH64_createState_wrapper()
+		if zw.xxhState == 0 {
+			panic(fmt.Errorf("BUG: cannot allocate XXH64 state"))
+		}
+	}
+	C.XXH64_reset_wrapper(zw.xxhState)
+}
@@ -2,7 +2,9 @@ package gozstd
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -496,3 +498,722 @@ func TestWriterBig(t *testing.T) {
 		t.Fatalf("unequal writtenBB and readBB\nwrittenBB=\n%X\nreadBB=\n%X", writtenBB.Bytes(), readBB.Bytes())
 	}
 }
+
+func TestWriterInvalidParams(t *testing.T) {
+	var bb bytes.Buffer
+	params := &WriterParams{
+		WindowLog: 100,
+	}
+	zw := NewWriterParams(&bb, params)
+	defer zw.Release()
+
+	// The error must be returned from all the calls.
+	if _, err := zw.Write([]byte("foobar")); !errors.Is(err, ErrParameterOutOfBound) {
+		t.Fatalf("unexpected error in Write; got %v; want %v", err, ErrParameterOutOfBound)
+	}
+	if _, err := zw.ReadFrom(bytes.NewBufferString("foobar")); !errors.Is(err, ErrParameterOutOfBound) {
+		t.Fatalf("unexpected error in ReadFrom; got %v; want %v", err, ErrParameterOutOfBound)
+	}
+	if err := zw.Flush(); !errors.Is(err, ErrParameterOutOfBound) {
+		t.Fatalf("unexpected error in Flush; got %v; want %v", err, ErrParameterOutOfBound)
+	}
+	if err := zw.Close(); !errors.Is(err, ErrParameterOutOfBound) {
+		t.Fatalf("unexpected error in Close; got %v; want %v", err, ErrParameterOutOfBound)
+	}
+	if bb.Len() > 0 {
+		t.Fatalf("unexpected data written to the underlying writer: %X", bb.Bytes())
+	}
+
+	// ResetWriterParams must clear the error.
+	zw.ResetWriterParams(&bb, &WriterParams{})
+	if err := testWriterExt(zw, "foobar"); err != nil {
+		t.Fatalf("unexpected error after ResetWriterParams: %s", err)
+	}
+	plainData, err := Decompress(nil, bb.Bytes())
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if string(plainData) != "foobar" {
+		t.Fatalf("unexpected data decompressed; got %q; want %q", plainData, "foobar")
+	}
+}
+
+func TestWriterStickyError(t *testing.T) {
+	errWriter := errors.New("writer failure")
+	ew := &errorWriter{err: errWriter}
+	zw := NewWriter(ew)
+	defer zw.Release()
+
+	if _, err := zw.Write([]byte("foobar")); err != nil {
+		t.Fatalf("unexpected error in Write: %s", err)
+	}
+	if err := zw.Flush(); !errors.Is(err, errWriter) {
+		t.Fatalf("unexpected error in Flush; got %v; want %v", err, errWriter)
+	}
+
+	// The error must be sticky even if the underlying writer recovers.
+	ew.err = nil
+	if _, err := zw.Write([]byte("foobar")); !errors.Is(err, errWriter) {
+		t.Fatalf("unexpected error in Write; got %v; want %v", err, errWriter)
+	}
+	if err := zw.Close(); !errors.Is(err, errWriter) {
+		t.Fatalf("unexpected error in Close; got %v; want %v", err, errWriter)
+	}
+
+	var bb bytes.Buffer
+	zw.ResetWriterParams(&bb, &WriterParams{})
+	if err := testWriterExt(zw, "foobar"); err != nil {
+		t.Fatalf("unexpected error after ResetWriterParams: %s", err)
+	}
+}
+
+func TestWriterShortWrite(t *testing.T) {
+	zw := NewWriter(&shortWriter{})
+	defer zw.Release()
+
+	if _, err := zw.Write([]byte(newTestString(1024, 3))); err != nil {
+		t.Fatalf("unexpected error in Write: %s", err)
+	}
+	if err := zw.Close(); !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("unexpected error in Close; got %v; want %v", err, io.ErrShortWrite)
+	}
+}
+
+type shortWriter struct{}
+
+func (*shortWriter) Write(p []byte) (int, error) {
+	return len(p) / 2, nil
+}
+
+func TestWriterParamsCompression(t *testing.T) {
+	src := []byte(newTestString(64*1024, 10))
+	for strategy := StrategyDefault; strategy <= StrategyBtUltra2; strategy++ {
+		params := &WriterParams{
+			Strategy: strategy,
+		}
+		testWriterParamsRoundtrip(t, params, src)
+	}
+
+	paramsList := []*WriterParams{
+		{HashLog: 16, ChainLog: 17, SearchLog: 3},
+		{MinMatch: 4, TargetLength: 64},
+		{Strategy: StrategyBtOpt, MinMatch: 3, TargetLength: 999},
+		{TargetCBlockSize: 2048},
+		{CompressionLevel: 19, WindowLog: 20, Strategy: StrategyFast},
+		{LongDistanceMatching: ParamSwitchEnable},
+		{LongDistanceMatching: ParamSwitchEnable, LdmHashLog: 20, LdmMinMatch: 64, LdmBucketSizeLog: 4, LdmHashRateLog: 6},
+		{LongDistanceMatching: ParamSwitchDisable, WindowLog: 27, Strategy: StrategyBtOpt},
+		{CompressionLevel: MaxCompressionLevel},
+	}
+	for _, params := range paramsList {
+		testWriterParamsRoundtrip(t, params, src)
+	}
+}
+
+func TestWriterParamsWorkers(t *testing.T) {
+	src := []byte(newTestString(4*1024*1024, 10))
+	paramsList := []*WriterParams{
+		{Workers: 1},
+		{Workers: 4},
+		{Workers: 4, JobSize: 512 * 1024, OverlapLog: 5},
+		{Workers: 2, CompressionLevel: 10, OverlapLog: 9},
+	}
+	for _, params := range paramsList {
+		testWriterParamsRoundtrip(t, params, src)
+	}
+}
+
+func testWriterParamsRoundtrip(t *testing.T, params *WriterParams, src []byte) {
+	t.Helper()
+
+	var bb bytes.Buffer
+	zw := NewWriterParams(&bb, params)
+	defer zw.Release()
+	if _, err := zw.Write(src); err != nil {
+		t.Fatalf("cannot write data with %+v: %s", params, err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close zw with %+v: %s", params, err)
+	}
+	plainData, err := Decompress(nil, bb.Bytes())
+	if err != nil {
+		t.Fatalf("cannot decompress data written with %+v: %s", params, err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected data decompressed for %+v", params)
+	}
+}
+
+func TestWriterParamsOutOfBounds(t *testing.T) {
+	paramsList := []*WriterParams{
+		{Strategy: StrategyBtUltra2 + 1},
+		{Strategy: -1},
+		{HashLog: 1},
+		{ChainLog: 100},
+		{SearchLog: -1},
+		{MinMatch: 100},
+		{TargetLength: -1},
+		{TargetCBlockSize: 10},
+		{Workers: -1},
+		{LdmHashLog: 100},
+		{LdmMinMatch: 1},
+		{LongDistanceMatching: ParamSwitchDisable + 1},
+		{LongDistanceMatching: -1},
+		{Workers: 4, OverlapLog: 10},
+	}
+	for _, params := range paramsList {
+		zw := NewWriterParams(ioutil.Discard, params)
+		if _, err := zw.Write([]byte("foobar")); !errors.Is(err, ErrParameterOutOfBound) {
+			t.Fatalf("unexpected error for %+v; got %v; want %v", params, err, ErrParameterOutOfBound)
+		}
+		zw.Release()
+	}
+}
+
+func TestWriterParamsReset(t *testing.T) {
+	src := []byte(newTestString(64*1024, 10))
+
+	var bb bytes.Buffer
+	params := &WriterParams{
+		Strategy:  StrategyFast,
+		WindowLog: 15,
+	}
+	zw := NewWriterParams(&bb, params)
+	defer zw.Release()
+
+	// Reset must preserve params other than compression level and dict.
+	zw.Reset(&bb, nil, 5)
+	if zw.params.Strategy != StrategyFast || zw.params.WindowLog != 15 {
+		t.Fatalf("Reset must preserve params; got %+v", zw.params)
+	}
+
+	// ResetWriterParams must reset params to defaults.
+	zw.ResetWriterParams(&bb, &WriterParams{})
+	if zw.params.Strategy != StrategyDefault || zw.params.WindowLog != 0 {
+		t.Fatalf("ResetWriterParams must override params; got %+v", zw.params)
+	}
+	if _, err := zw.Write(src); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close zw: %s", err)
+	}
+	plainData, err := Decompress(nil, bb.Bytes())
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected data decompressed")
+	}
+}
+
+func TestWriterParamsNoDictID(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf("sample %d for dict id", i)))
+	}
+	dict := BuildDict(samples, 8*1024)
+	cd, err := NewCDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	defer cd.Release()
+	dd, err := NewDDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create DDict: %s", err)
+	}
+	defer dd.Release()
+
+	src := []byte("sample 123 for dict id")
+	compress := func(noDictID bool) []byte {
+		var bb bytes.Buffer
+		zw := NewWriterParams(&bb, &WriterParams{Dict: cd, NoDictID: noDictID})
+		defer zw.Release()
+		if _, err := zw.Write(src); err != nil {
+			t.Fatalf("cannot write data: %s", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("cannot close zw: %s", err)
+		}
+		return bb.Bytes()
+	}
+
+	withDictID := compress(false)
+	withoutDictID := compress(true)
+	if len(withoutDictID) >= len(withDictID) {
+		t.Fatalf("frame without dict id must be shorter; got %d bytes; want less than %d bytes", len(withoutDictID), len(withDictID))
+	}
+	plainData, err := DecompressDict(nil, withoutDictID, dd)
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected data decompressed; got %q; want %q", plainData, src)
+	}
+}
+
+func TestWriterContentChecksum(t *testing.T) {
+	var bb bytes.Buffer
+	zw := NewWriterParams(&bb, &WriterParams{Checksum: true})
+	defer zw.Release()
+	if _, ok := zw.ContentChecksum(); ok {
+		t.Fatalf("content checksum mustn't be available before Close")
+	}
+
+	f := func(data string, checksumExpected uint64) {
+		t.Helper()
+		bb.Reset()
+		zw.Reset(&bb, nil, 0)
+		if _, err := zw.Write([]byte(data)); err != nil {
+			t.Fatalf("cannot write data: %s", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("cannot close zw: %s", err)
+		}
+		checksum, ok := zw.ContentChecksum()
+		if !ok {
+			t.Fatalf("content checksum must be available after Close")
+		}
+		if checksum != checksumExpected {
+			t.Fatalf("unexpected content checksum for %q; got %016X; want %016X", data, checksum, checksumExpected)
+		}
+
+		// The frame must end with the lower 32 bits of the checksum.
+		cd := bb.Bytes()
+		fh, err := ParseFrameHeader(cd)
+		if err != nil {
+			t.Fatalf("cannot parse frame header: %s", err)
+		}
+		if !fh.HasChecksum {
+			t.Fatalf("expecting frame with checksum")
+		}
+		if n := binary.LittleEndian.Uint32(cd[len(cd)-4:]); n != uint32(checksum) {
+			t.Fatalf("unexpected checksum in the frame; got %08X; want %08X", n, uint32(checksum))
+		}
+		plainData, err := Decompress(nil, cd)
+		if err != nil {
+			t.Fatalf("cannot decompress data: %s", err)
+		}
+		if string(plainData) != data {
+			t.Fatalf("unexpected data decompressed; got %q; want %q", plainData, data)
+		}
+	}
+	f("", 0xEF46DB3751D8E999)
+	f("abc", 0x44BC2CF5AD770999)
+
+	// The checksum must cover data written via multiple calls.
+	src := newTestString(1024*1024, 3)
+	zw.Reset(ioutil.Discard, nil, 0)
+	if _, err := zw.ReadFrom(strings.NewReader(src)); err != nil {
+		t.Fatalf("cannot read data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close zw: %s", err)
+	}
+	checksum, _ := zw.ContentChecksum()
+	f(src, checksum)
+
+	// Reset must drop the checksum.
+	zw.Reset(ioutil.Discard, nil, 0)
+	if _, ok := zw.ContentChecksum(); ok {
+		t.Fatalf("content checksum mustn't be available after Reset")
+	}
+
+	// The checksum isn't available without WriterParams.Checksum.
+	zw.ResetWriterParams(&bb, &WriterParams{})
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close zw: %s", err)
+	}
+	if _, ok := zw.ContentChecksum(); ok {
+		t.Fatalf("content checksum mustn't be available without WriterParams.Checksum")
+	}
+}
+
+func TestWriterContentChecksumMultipleFrames(t *testing.T) {
+	var bb bytes.Buffer
+	zw := NewWriterParams(&bb, &WriterParams{Checksum: true})
+	defer zw.Release()
+
+	// The checksum must cover the data in all the frames.
+	for _, s := range []string{"a", "b", "c"} {
+		if _, err := zw.Write([]byte(s)); err != nil {
+			t.Fatalf("cannot write data: %s", err)
+		}
+		if err := zw.EndFrame(); err != nil {
+			t.Fatalf("cannot end frame: %s", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close zw: %s", err)
+	}
+	const checksumExpected = 0x44BC2CF5AD770999 // XXH64("abc")
+	if checksum, ok := zw.ContentChecksum(); !ok || checksum != checksumExpected {
+		t.Fatalf("unexpected content checksum; got %016X, %v; want %016X, true", checksum, ok, uint64(checksumExpected))
+	}
+	plainData, err := Decompress(nil, bb.Bytes())
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if string(plainData) != "abc" {
+		t.Fatalf("unexpected data decompressed; got %q; want %q", plainData, "abc")
+	}
+
+	// The checksum of the data split into frames must match the checksum
+	// of the same data written in a single frame.
+	data := newTestString(1024*1024, 3)
+	bb.Reset()
+	zw.Reset(&bb, nil, 0)
+	if err := testWriterExt(zw, data); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	checksumExpected1, _ := zw.ContentChecksum()
+	cd := bb.Bytes()
+	if n := binary.LittleEndian.Uint32(cd[len(cd)-4:]); n != uint32(checksumExpected1) {
+		t.Fatalf("unexpected checksum in the frame; got %08X; want %08X", n, uint32(checksumExpected1))
+	}
+
+	zw.ResetWriterParams(ioutil.Discard, &WriterParams{Checksum: true, FrameSize: 100 * 1024})
+	if err := testWriterExt(zw, data); err != nil {
+		t.Fatalf("cannot write data with FrameSize: %s", err)
+	}
+	if checksum, _ := zw.ContentChecksum(); checksum != checksumExpected1 {
+		t.Fatalf("unexpected content checksum with FrameSize; got %016X; want %016X", checksum, checksumExpected1)
+	}
+}
+
+func TestWriterSetPledgedSize(t *testing.T) {
+	var bb bytes.Buffer
+	zw := NewWriter(&bb)
+	defer zw.Release()
+
+	// Write multiple frames with distinct pledged sizes.
+	var frames []string
+	for _, size := range []int{0, 1, 1000, 300 * 1024} {
+		data := newTestString(size, 3)
+		if err := zw.SetPledgedSize(int64(size)); err != nil {
+			t.Fatalf("cannot set pledged size %d: %s", size, err)
+		}
+		if _, err := zw.Write([]byte(data)); err != nil {
+			t.Fatalf("cannot write data: %s", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("cannot close zw: %s", err)
+		}
+		frames = append(frames, data)
+	}
+
+	cd := bb.Bytes()
+	for i, data := range frames {
+		fh, err := ParseFrameHeader(cd)
+		if err != nil {
+			t.Fatalf("cannot parse frame header #%d: %s", i, err)
+		}
+		if fh.ContentSize != uint64(len(data)) {
+			t.Fatalf("unexpected content size in frame #%d; got %d; want %d", i, fh.ContentSize, len(data))
+		}
+		n, err := findFrameCompressedSize(cd)
+		if err != nil {
+			t.Fatalf("cannot find size of frame #%d: %s", i, err)
+		}
+		cd = cd[n:]
+	}
+	plainData, err := Decompress(nil, bb.Bytes())
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if string(plainData) != strings.Join(frames, "") {
+		t.Fatalf("unexpected data decompressed")
+	}
+
+	// The pledged size doesn't apply to the next frame.
+	bb.Reset()
+	if err := testWriterExt(zw, "foobar"); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	fh, err := ParseFrameHeader(bb.Bytes())
+	if err != nil {
+		t.Fatalf("cannot parse frame header: %s", err)
+	}
+	if fh.ContentSize != ContentSizeUnknown {
+		t.Fatalf("unexpected content size; got %d; want %d", fh.ContentSize, ContentSizeUnknown)
+	}
+}
+
+func TestWriterSetPledgedSizeMismatch(t *testing.T) {
+	data := []byte(newTestString(1000, 3))
+	for _, size := range []int64{0, int64(len(data)) - 1, int64(len(data)) + 1} {
+		zw := NewWriter(ioutil.Discard)
+		if err := zw.SetPledgedSize(size); err != nil {
+			t.Fatalf("cannot set pledged size %d: %s", size, err)
+		}
+		_, err := zw.Write(data)
+		if err == nil {
+			err = zw.Close()
+		}
+		if !errors.Is(err, ErrSrcSizeWrong) {
+			t.Fatalf("unexpected error for pledged size %d; got %v; want %v", size, err, ErrSrcSizeWrong)
+		}
+		zw.Release()
+	}
+}
+
+func TestWriterSetPledgedSizeInvalid(t *testing.T) {
+	zw := NewWriter(ioutil.Discard)
+	defer zw.Release()
+
+	if err := zw.SetPledgedSize(-1); err == nil {
+		t.Fatalf("expecting non-nil error for negative pledged size")
+	}
+
+	const errExpected = "cannot set pledged size 100 after writing data to the frame"
+	if _, err := zw.Write([]byte("foobar")); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := zw.SetPledgedSize(100); err == nil || err.Error() != errExpected {
+		t.Fatalf("unexpected error when setting pledged size after Write; got %v; want %q", err, errExpected)
+	}
+	if err := zw.Flush(); err != nil {
+		t.Fatalf("cannot flush zw: %s", err)
+	}
+	if err := zw.SetPledgedSize(100); err == nil || err.Error() != errExpected {
+		t.Fatalf("unexpected error when setting pledged size after Flush; got %v; want %q", err, errExpected)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close zw: %s", err)
+	}
+
+	// Large writes are passed directly to zstd without buffering.
+	zw.Reset(ioutil.Discard, nil, 0)
+	if _, err := zw.Write(make([]byte, 4*int(cstreamInBufSize))); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := zw.SetPledgedSize(100); err == nil || err.Error() != errExpected {
+		t.Fatalf("unexpected error when setting pledged size after large Write; got %v; want %q", err, errExpected)
+	}
+
+	// The pledged size may be set for the next frame.
+	if err := zw.EndFrame(); err != nil {
+		t.Fatalf("cannot end frame: %s", err)
+	}
+	if err := zw.SetPledgedSize(0); err != nil {
+		t.Fatalf("cannot set pledged size for the next frame: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close zw: %s", err)
+	}
+}
+
+func TestWriterEndFrame(t *testing.T) {
+	var bb bytes.Buffer
+	zw := NewWriterParams(&bb, &WriterParams{
+		WindowLog: 20,
+		Checksum:  true,
+	})
+	defer zw.Release()
+
+	var frames []string
+	for i := 0; i < 3; i++ {
+		data := newTestString(10000*(i+1), 3)
+		if err := zw.SetPledgedSize(int64(len(data))); err != nil {
+			t.Fatalf("cannot set pledged size for frame #%d: %s", i, err)
+		}
+		if _, err := zw.Write([]byte(data)); err != nil {
+			t.Fatalf("cannot write frame #%d: %s", i, err)
+		}
+		if err := zw.EndFrame(); err != nil {
+			t.Fatalf("cannot end frame #%d: %s", i, err)
+		}
+		frames = append(frames, data)
+	}
+
+	chunks, err := SplitFrames(bb.Bytes())
+	if err != nil {
+		t.Fatalf("cannot split frames: %s", err)
+	}
+	if len(chunks) != len(frames) {
+		t.Fatalf("unexpected number of frames; got %d; want %d", len(chunks), len(frames))
+	}
+	for i, chunk := range chunks {
+		fh, err := ParseFrameHeader(chunk)
+		if err != nil {
+			t.Fatalf("cannot parse header for frame #%d: %s", i, err)
+		}
+		if fh.ContentSize != uint64(len(frames[i])) || !fh.HasChecksum {
+			t.Fatalf("unexpected header for frame #%d: %+v", i, fh)
+		}
+		plainData, err := Decompress(nil, chunk)
+		if err != nil {
+			t.Fatalf("cannot decompress frame #%d: %s", i, err)
+		}
+		if string(plainData) != frames[i] {
+			t.Fatalf("unexpected data decompressed from frame #%d", i)
+		}
+	}
+}
+
+func TestWriterFrameSize(t *testing.T) {
+	const frameSize = 100 * 1024
+	for _, dataSize := range []int{0, 1, frameSize - 1, frameSize, frameSize + 1, 3*frameSize + 123, 4 * frameSize} {
+		data := newTestString(dataSize, 3)
+		framesExpected := (dataSize + frameSize - 1) / frameSize
+		if framesExpected == 0 {
+			// Close writes an empty frame.
+			framesExpected = 1
+		}
+
+		// Write data in chunks of random sizes.
+		var bb bytes.Buffer
+		zw := NewWriterParams(&bb, &WriterParams{FrameSize: frameSize})
+		if err := testWriterExt(zw, data); err != nil {
+			t.Fatalf("cannot write data of size %d: %s", dataSize, err)
+		}
+		testWriterFrameSize(t, bb.Bytes(), data, frameSize, framesExpected)
+
+		// Write data via ReadFrom.
+		bb.Reset()
+		zw.Reset(&bb, nil, 0)
+		if _, err := zw.ReadFrom(strings.NewReader(data)); err != nil {
+			t.Fatalf("cannot read data of size %d: %s", dataSize, err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("cannot close zw: %s", err)
+		}
+		testWriterFrameSize(t, bb.Bytes(), data, frameSize, framesExpected)
+		zw.Release()
+	}
+
+	zw := NewWriterParams(ioutil.Discard, &WriterParams{FrameSize: -1})
+	defer zw.Release()
+	if _, err := zw.Write([]byte("foobar")); err == nil {
+		t.Fatalf("expecting non-nil error for negative FrameSize")
+	}
+}
+
+func testWriterFrameSize(t *testing.T, cd []byte, data string, frameSize, framesExpected int) {
+	t.Helper()
+
+	chunks, err := SplitFrames(cd)
+	if err != nil {
+		t.Fatalf("cannot split frames: %s", err)
+	}
+	if len(chunks) != framesExpected {
+		t.Fatalf("unexpected number of frames for data of size %d; got %d; want %d", len(data), len(chunks), framesExpected)
+	}
+	var plainData []byte
+	for i, chunk := range chunks {
+		n := len(plainData)
+		plainData, err = Decompress(plainData, chunk)
+		if err != nil {
+			t.Fatalf("cannot decompress frame #%d: %s", i, err)
+		}
+		if size := len(plainData) - n; i < len(chunks)-1 && size != frameSize {
+			t.Fatalf("unexpected size of frame #%d; got %d; want %d", i, size, frameSize)
+		}
+	}
+	if string(plainData) != data {
+		t.Fatalf("unexpected data decompressed for data of size %d", len(data))
+	}
+}
+
+func TestWriterLargeWrites(t *testing.T) {
+	const frameSize = 1024 * 1024
+	data := newTestString(5*frameSize+123, 3)
+	for _, params := range []*WriterParams{
+		{},
+		{Checksum: true},
+		{FrameSize: frameSize, Checksum: true},
+	} {
+		var bb bytes.Buffer
+		zw := NewWriterParams(&bb, params)
+
+		// Mix small writes, which are buffered, with large writes,
+		// which are passed directly to zstd.
+		b := []byte(data)
+		for i := 0; len(b) > 0; i++ {
+			n := 1 + (i%3)*int(cstreamInBufSize)*5
+			if n > len(b) {
+				n = len(b)
+			}
+			if _, err := zw.Write(b[:n]); err != nil {
+				t.Fatalf("cannot write data with %+v: %s", params, err)
+			}
+			b = b[n:]
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("cannot close zw with %+v: %s", params, err)
+		}
+		if params.FrameSize > 0 {
+			testWriterFrameSize(t, bb.Bytes(), data, frameSize, (len(data)+frameSize-1)/frameSize)
+		}
+		plainData, err := Decompress(nil, bb.Bytes())
+		if err != nil {
+			t.Fatalf("cannot decompress data written with %+v: %s", params, err)
+		}
+		if string(plainData) != data {
+			t.Fatalf("unexpected data decompressed for %+v", params)
+		}
+		if params.Checksum && params.FrameSize == 0 {
+			checksum, ok := zw.ContentChecksum()
+			if !ok {
+				t.Fatalf("missing content checksum")
+			}
+			// Decompress verifies the checksum stored in the frame,
+			// so it is enough to compare it with the content checksum.
+			cd := bb.Bytes()
+			if n := binary.LittleEndian.Uint32(cd[len(cd)-4:]); n != uint32(checksum) {
+				t.Fatalf("unexpected checksum in the frame; got %08X; want %08X", n, uint32(checksum))
+			}
+		}
+		zw.Release()
+	}
+}
+
+func TestWriterParamsContext(t *testing.T) {
+	data := []byte(newTestString(1024*1024, 3))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var bb bytes.Buffer
+	zw := NewWriterParams(&bb, &WriterParams{Context: ctx})
+	defer zw.Release()
+
+	// Small writes are buffered, so the error is returned on Close.
+	if _, err := zw.Write(data[:10]); err != nil {
+		t.Fatalf("unexpected error for buffered write: %s", err)
+	}
+	if err := zw.Close(); err != context.Canceled {
+		t.Fatalf("unexpected error on Close; got %v; want %v", err, context.Canceled)
+	}
+
+	// Large writes must return the error immediately. It must be sticky.
+	zw.ResetWriterParams(&bb, &WriterParams{Context: ctx})
+	if _, err := zw.Write(data); err != context.Canceled {
+		t.Fatalf("unexpected error on Write; got %v; want %v", err, context.Canceled)
+	}
+	if err := zw.Flush(); err != context.Canceled {
+		t.Fatalf("unexpected error on Flush; got %v; want %v", err, context.Canceled)
+	}
+
+	// The writer must be usable after Reset, which drops the context,
+	// and after resetting the context.
+	for _, reset := range []func(){
+		func() { zw.Reset(&bb, nil, 0) },
+		func() { zw.ResetWriterParams(&bb, &WriterParams{Context: context.Background()}) },
+	} {
+		bb.Reset()
+		reset()
+		if _, err := zw.Write(data); err != nil {
+			t.Fatalf("cannot write data: %s", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("cannot close zw: %s", err)
+		}
+		plainData, err := Decompress(nil, bb.Bytes())
+		if err != nil {
+			t.Fatalf("cannot decompress data: %s", err)
+		}
+		if !bytes.Equal(plainData, data) {
+			t.Fatalf("unexpected data decompressed")
+		}
+	}
+}
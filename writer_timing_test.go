@@ -77,6 +77,18 @@ func benchmarkWriter(b *testing.B, blockSize, level int) {
 	})
 }
 
+// benchLargeBlockSizes are block sizes for benchmarking the paths,
+// which pass data between caller buffers and zstd without copying.
+var benchLargeBlockSizes = []int{1 << 20, 4 << 20}
+
+func BenchmarkWriterLargeBlocks(b *testing.B) {
+	for _, blockSize := range benchLargeBlockSizes {
+		b.Run(fmt.Sprintf("blockSize_%d", blockSize), func(b *testing.B) {
+			benchmarkWriter(b, blockSize, 1)
+		})
+	}
+}
+
 func BenchmarkWriterResetAlloc(b *testing.B) {
 	b.ReportAllocs()
 